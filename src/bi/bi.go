@@ -5,22 +5,109 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 func usage() {
-	fmt.Println("usage:  bi [-B] <input file.go>")
+	fmt.Println("usage:  bi [-B] [-strict] [-sortkeys] [-zerocopy] [-type A,B] [-o output.go] <input file.go ... | package dir>")
+	fmt.Println("        bi [flags]    (from //go:generate, reads $GOFILE and writes <name>_binidl.go)")
 }
 
 var bigEndian *bool = flag.Bool("B", false, "Use big endian encoding (default: little)")
+var strict *bool = flag.Bool("strict", false, "Reject non-canonical input when unmarshaling")
+var sortKeys *bool = flag.Bool("sortkeys", false, "Marshal map entries in sorted key order")
+var typeNames *string = flag.String("type", "", "Comma-separated list of types to generate (default: all)")
+var zeroCopy *bool = flag.Bool("zerocopy", false, "Point []byte and string fields into the input of UnmarshalFromBytes")
+var output *string = flag.String("o", "", "Write the generated code to this file (default: standard output)")
+
+// writeFile replaces filename with data all at once, so that a failed
+// run never leaves a half-written file behind.
+func writeFile(filename string, data []byte) error {
+	tf, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+	if _, err := tf.Write(data); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Chmod(0644); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tf.Name(), filename)
+}
+
+// fatal prints err, one line per error like a compiler, and exits.
+func fatal(err error) {
+	if list, ok := err.(binidl.ErrorList); ok {
+		for _, e := range list {
+			fmt.Fprintln(os.Stderr, e)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, "bi:", err)
+	}
+	os.Exit(1)
+}
 
 func main() {
 	flag.Parse()
 
-	if flag.NArg() < 1 {
+	// go generate sets $GOFILE to the file containing the directive.
+	inputs := flag.Args()
+	gofile := os.Getenv("GOFILE")
+	if len(inputs) == 0 && gofile != "" {
+		inputs = []string{gofile}
+	}
+	if *output == "" && gofile != "" {
+		*output = strings.TrimSuffix(gofile, ".go") + "_binidl.go"
+	}
+	if len(inputs) < 1 {
 		usage()
 		os.Exit(-1)
 	}
 
-	bi := binidl.NewBinidl(flag.Arg(0), *bigEndian)
-	bi.PrintGo()
+	var bi *binidl.Binidl
+	var err error
+	if len(inputs) > 1 {
+		bi, err = binidl.NewBinidlFiles(inputs, *bigEndian)
+	} else {
+		bi, err = binidl.NewBinidl(inputs[0], *bigEndian)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	bi.SetStrict(*strict)
+	bi.SetSortMapKeys(*sortKeys)
+	bi.SetZeroCopy(*zeroCopy)
+	if *typeNames != "" {
+		bi.SetTypes(strings.Split(*typeNames, ","))
+	}
+	bi.SetSkipFunc(func(e *binidl.Error) {
+		fmt.Fprintf(os.Stderr, "%s: skipping %s: %s\n", e.Pos, e.Type, e.Msg)
+	})
+	src, err := bi.GenerateSource()
+	if err != nil {
+		if _, ok := err.(binidl.ErrorList); !ok && src != nil {
+			// A bug in the generator, so keep the output around.
+			if tf, terr := os.CreateTemp("", "bi-*.go"); terr == nil {
+				tf.Write(src)
+				tf.Close()
+				err = fmt.Errorf("%v (output left in %s)", err, tf.Name())
+			}
+		}
+		fatal(err)
+	}
+	if *output == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := writeFile(*output, src); err != nil {
+		fatal(err)
+	}
 }
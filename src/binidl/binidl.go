@@ -2,80 +2,289 @@ package binidl
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"go/ast"
+	"go/build"
+	"go/format"
 	"go/parser"
-	"go/printer"
 	"go/token"
+	"go/types"
 	"io"
-	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 type Binidl struct {
-	ast       *ast.File
+	files     []*ast.File
+	pkgFiles  []*ast.File // The rest of the package, only type-checked
 	fset      *token.FileSet
 	bigEndian bool
+	strict    bool
+	sortKeys  bool
+	zeroCopy  bool
+	types     []string // Types to generate, or nil for all
+	skipFunc  func(*Error)
 }
 
 const (
-	STATICMAX = 64 // Max size of an object for which we marshal into a stack-allocated local buffer
+	STATICMAX  = 64      // Max size of an object for which we marshal into a stack-allocated local buffer
+	MAPHINTMAX = 1024    // Max size hint for a map or slice read from a stream, which can grow from there
+	READCHUNK  = 1 << 16 // Bytes read at a time when the stream says how many to expect
 )
 
-func NewBinidl(filename string, bigEndian bool) *Binidl {
-	fset := token.NewFileSet()
-	ast, err := parser.ParseFile(fset, filename, nil, 0) // scanner.InsertSemis)
+// NewBinidl parses filename, which is either a Go file or a package
+// directory.  Syntax errors are returned as an ErrorList.
+func NewBinidl(filename string, bigEndian bool) (*Binidl, error) {
+	if fi, err := os.Stat(filename); err == nil && fi.IsDir() {
+		return NewBinidlDir(filename, bigEndian)
+	}
+	return NewBinidlFiles([]string{filename}, bigEndian)
+}
+
+// NewBinidlFiles parses several files of one package.  Their types may
+// refer to each other and are all generated into a single output.
+func NewBinidlFiles(filenames []string, bigEndian bool) (*Binidl, error) {
+	bi := &Binidl{fset: token.NewFileSet(), bigEndian: bigEndian}
+	var errs ErrorList
+	for _, filename := range filenames {
+		f, err := parser.ParseFile(bi.fset, filename, nil, parser.ParseComments)
+		if err != nil {
+			errs = append(errs, parseErrors(err)...)
+			continue
+		}
+		if len(bi.files) > 0 && f.Name.Name != bi.files[0].Name.Name {
+			errs = append(errs, &Error{Pos: bi.fset.Position(f.Name.Pos()),
+				Msg: fmt.Sprintf("package %s, not %s", f.Name.Name, bi.files[0].Name.Name)})
+			continue
+		}
+		bi.files = append(bi.files, f)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	bi.parsePackage(filenames)
+	return bi, nil
+}
+
+// parsePackage parses the other files of the package that filenames
+// belong to, so that their types can be used.  Files that don't parse
+// are left out: the type checker will complain about what they declare
+// if it matters.
+func (bi *Binidl) parsePackage(filenames []string) {
+	seen := make(map[string]bool)
+	for _, filename := range filenames {
+		if abs, err := filepath.Abs(filename); err == nil {
+			seen[abs] = true
+		}
+	}
+	for _, filename := range filenames {
+		dir := filepath.Dir(filename)
+		others, err := packageFiles(dir)
+		if err != nil {
+			continue
+		}
+		for _, other := range others {
+			abs, err := filepath.Abs(other)
+			if err != nil || seen[abs] {
+				continue
+			}
+			seen[abs] = true
+			f, err := parser.ParseFile(bi.fset, other, nil, 0)
+			if err == nil && f.Name.Name == bi.files[0].Name.Name {
+				bi.pkgFiles = append(bi.pkgFiles, f)
+			}
+		}
+	}
+}
+
+// NewBinidlDir parses the Go files in dir, leaving out tests, files
+// excluded by build constraints and generated code such as our own output.
+func NewBinidlDir(dir string, bigEndian bool) (*Binidl, error) {
+	filenames, err := packageFiles(dir)
 	if err != nil {
-		fmt.Println("Error parsing", filename, ":", err)
-		return nil
+		return nil, ErrorList{{Msg: err.Error()}}
 	}
-	return &Binidl{ast, fset, bigEndian}
+	if len(filenames) == 0 {
+		return nil, ErrorList{{Pos: token.Position{Filename: dir}, Msg: "no Go files"}}
+	}
+	return NewBinidlFiles(filenames, bigEndian)
+}
+
+// packageFiles lists the files in dir that go build would compile,
+// other than generated ones.
+func packageFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var filenames []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if match, err := build.Default.MatchFile(dir, name); err == nil && !match {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		f, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.PackageClauseOnly|parser.ParseComments)
+		if err == nil && ast.IsGenerated(f) {
+			continue
+		}
+		filenames = append(filenames, path)
+	}
+	return filenames, nil
+}
+
+// SetStrict makes the generated Unmarshal reject encodings that
+// binary.Read would silently accept, such as a bool byte other than 0 or 1.
+func (bi *Binidl) SetStrict(strict bool) {
+	bi.strict = strict
+}
+
+// SetSortMapKeys makes the generated Marshal write map entries in key
+// order, so that equal maps always produce identical bytes.
+func (bi *Binidl) SetSortMapKeys(sortKeys bool) {
+	bi.sortKeys = sortKeys
+}
+
+// SetZeroCopy makes the generated UnmarshalFromBytes point []byte and
+// string fields into its input instead of copying them out.
+func (bi *Binidl) SetZeroCopy(zeroCopy bool) {
+	bi.zeroCopy = zeroCopy
+}
+
+// SetSkipFunc has f called with each type that gets no methods, with why
+// in the Error's Msg, before GenerateSource or Generate returns.
+func (bi *Binidl) SetSkipFunc(f func(*Error)) {
+	bi.skipFunc = f
+}
+
+// SetTypes limits generation to the named types and the types they use.
+// Otherwise every type is generated except those marked //binidl:skip.
+func (bi *Binidl) SetTypes(types []string) {
+	bi.types = types
 }
 
 func setbs(b io.Writer, n int, es *EmitState) {
+	if es.op == APPEND {
+		// Grow dst and encode straight into its new tail.
+		fmt.Fprintf(b, "dst = append(dst, make([]byte, %d)...)\n", n)
+		fmt.Fprintf(b, "bs = dst[len(dst)-%d:]\n", n)
+		es.usedBs = true
+		return
+	}
 	if n != es.curBSize {
 		fmt.Fprintf(b, "bs = b[:%d]\n", n)
 	}
 	es.curBSize = n
+	es.usedB, es.usedBs = true, true
+}
+
+// readbs points bs at the next n bytes of input.
+func readbs(b io.Writer, n int, es *EmitState) {
+	if es.op == DECODE {
+		fmt.Fprintf(b, "if len(data)-n < %d {\n", n)
+		fmt.Fprintf(b, "return n, io.ErrUnexpectedEOF\n")
+		fmt.Fprintf(b, "}\n")
+		fmt.Fprintf(b, "bs = data[n : n+%d]\n", n)
+		fmt.Fprintf(b, "n += %d\n", n)
+		es.usedBs = true
+		return
+	}
+	setbs(b, n, es)
+	fmt.Fprintf(b, "if _, err := io.ReadAtLeast(wire, bs, %d); err != nil {\n", n)
+	fmt.Fprintf(b, " return err\n")
+	fmt.Fprintf(b, "}\n")
 }
 
-func unmarshalField(b io.Writer, fname, tname string, es *EmitState) {
-	tconv := tname
-	if mapped, ok := typemap[tname]; ok {
-		tconv = mapped
+// readBytes fills the byte slice dst, of length count, from the input.
+func readBytes(b io.Writer, dst, count string, es *EmitState) {
+	if es.op == DECODE {
+		fmt.Fprintf(b, "if int64(len(data)-n) < %s {\n", count)
+		fmt.Fprintf(b, "return n, io.ErrUnexpectedEOF\n")
+		fmt.Fprintf(b, "}\n")
+		fmt.Fprintf(b, "n += copy(%s, data[n:])\n", dst)
+		return
 	}
+	fmt.Fprintf(b, "if _, err := io.ReadFull(wire, %s); err != nil {\n", dst)
+	fmt.Fprintf(b, "return err\n")
+	fmt.Fprintf(b, "}\n")
+}
+
+// readLong appends count bytes from wire to the byte slice dst.  count
+// comes from the stream, so rather than allocating it all up front, dst
+// only grows as the bytes arrive, and a stream that ends early is an
+// io.ErrUnexpectedEOF instead of a huge allocation.
+func readLong(b io.Writer, dst, count string, es *EmitState) {
+	fmt.Fprintf(b, "for int64(len(%s)) < %s {\n", dst, count)
+	fmt.Fprintf(b, "chunk := %s - int64(len(%s))\n", count, dst)
+	fmt.Fprintf(b, "if chunk > %d {\n", READCHUNK)
+	fmt.Fprintf(b, "chunk = %d\n", READCHUNK)
+	fmt.Fprintf(b, "}\n")
+	fmt.Fprintf(b, "%s = append(%s, make([]byte, chunk)...)\n", dst, dst)
+	fmt.Fprintf(b, "if _, err := io.ReadFull(wire, %s[int64(len(%s))-chunk:]); err != nil {\n", dst, dst)
+	fmt.Fprintf(b, "if err == io.EOF {\n")
+	fmt.Fprintf(b, "err = io.ErrUnexpectedEOF\n")
+	fmt.Fprintf(b, "}\n")
+	fmt.Fprintf(b, "return err\n")
+	fmt.Fprintf(b, "}\n")
+	fmt.Fprintf(b, "}\n")
+}
+
+// readHint declares hintid as the smaller of count and limit, for sizing
+// something whose length comes from the input.
+func readHint(b io.Writer, hintid, count, limit string) {
+	fmt.Fprintf(b, "%s := %s\n", hintid, count)
+	fmt.Fprintf(b, "if %s > %s {\n", hintid, limit)
+	fmt.Fprintf(b, "%s = %s\n", hintid, limit)
+	fmt.Fprintf(b, "}\n")
+}
 
-	ti, ok := typedb[tconv]
+func unmarshalField(b io.Writer, fname string, t ast.Expr, es *EmitState) {
+	ti, ok := es.g.basic(t)
 	if !ok {
-		fmt.Fprintf(b, "%s.Unmarshal(wire)\n", fname)
+		dispatch(b, fname, "Unmarshal", es)
+		return
+	}
+	tname := es.g.typeString(t)
+	if ti.EncodesAs == "string" {
+		unmarshalString(b, fname, tname, es)
+		return
+	}
+	if es.tag.varint || es.tag.uvarint {
+		unmarshalVarint(b, fname, tname, ti, es)
 		return
 	}
 
 	bstart := 0
 	source := "bs"
 	if es.resetBuffer {
-		setbs(b, ti.Size, es)
+		readbs(b, ti.Size, es)
 		bstart = 0
-		fmt.Fprintf(b, "if _, err := io.ReadAtLeast(wire, bs, %d); err != nil {\n", ti.Size)
-		fmt.Fprintf(b, " return err\n")
-		fmt.Fprintf(b, "}\n")
 	} else {
 		bstart = es.Bstart(ti.Size)
 		if es.contiguous[es.crt] > 0 && bstart == 0 {
-			setbs(b, es.contiguous[es.crt], es)
-			fmt.Fprintf(b, "if _, err := io.ReadAtLeast(wire, bs, %d); err != nil {\n", es.contiguous[es.crt])
-			fmt.Fprintf(b, " return err\n")
-			fmt.Fprintf(b, "}\n")
+			readbs(b, es.contiguous[es.crt], es)
 		}
 	}
 
+	if ti.EncodesAs == "bool" && es.strict {
+		es.g.need.errors = true
+		fmt.Fprintf(b, "if %s[%d] > 1 {\n", source, bstart)
+		fmt.Fprintf(b, "%s\n", es.returnErr(fmt.Sprintf("errors.New(\"%s: invalid bool\")", fname)))
+		fmt.Fprintf(b, "}\n")
+	}
 	if ildf, found := inlineDecode[ti.EncodesAs]; found {
 		ild := ildf(source, bstart, es)
 		fmt.Fprintf(b, "%s = %s(%s)\n", fname, tname, ild)
 	} else {
-		need_binary = true
+		es.g.need.binary = true
 		endian := "Little"
 		if es.bigEndian {
 			endian = "Big"
@@ -93,13 +302,104 @@ func unmarshalField(b io.Writer, fname, tname string, es *EmitState) {
 	}
 }
 
-func marshalField(b io.Writer, fname, tname string, es *EmitState) {
-	if mapped, ok := typemap[tname]; ok {
-		tname = mapped
+// Types we don't know how to encode are assumed to have their own
+// Marshal and Unmarshal methods.
+func dispatch(b io.Writer, fname, funcname string, es *EmitState) {
+	if es.op == SIZE {
+		es.getNewAlen()
+		szid := fmt.Sprintf("sz%d", es.alenIdx)
+		fmt.Fprintf(b, "%s, ok := %s.BinarySize()\n", szid, fname)
+		fmt.Fprintf(b, "if !ok {\n")
+		fmt.Fprintf(b, "return 0, false\n")
+		fmt.Fprintf(b, "}\n")
+		fmt.Fprintf(b, "nbytes += %s\n", szid)
+		return
+	}
+	if es.op == APPEND {
+		es.getNewAlen()
+		dstid := fmt.Sprintf("dst%d", es.alenIdx)
+		fmt.Fprintf(b, "%s, err := %s.AppendBinary(dst)\n", dstid, fname)
+		fmt.Fprintf(b, "if err != nil {\n")
+		fmt.Fprintf(b, "return %s, err\n", dstid)
+		fmt.Fprintf(b, "}\n")
+		fmt.Fprintf(b, "dst = %s\n", dstid)
+		return
+	}
+	if es.op == DECODE && es.g.zeroCopy && !es.zeroCopy {
+		// UnmarshalFromBytes would alias the input, so read a copy.
+		es.g.need.bytes = true
+		es.getNewAlen()
+		rid := fmt.Sprintf("r%d", es.alenIdx)
+		errid := fmt.Sprintf("err%d", es.alenIdx)
+		fmt.Fprintf(b, "%s := bytes.NewReader(data[n:])\n", rid)
+		fmt.Fprintf(b, "%s := %s.Unmarshal(%s)\n", errid, fname, rid)
+		fmt.Fprintf(b, "n = len(data) - %s.Len()\n", rid)
+		fmt.Fprintf(b, "if %s == io.EOF {\n", errid)
+		fmt.Fprintf(b, "return n, io.ErrUnexpectedEOF\n")
+		fmt.Fprintf(b, "}\n")
+		fmt.Fprintf(b, "if %s != nil {\n", errid)
+		fmt.Fprintf(b, "return n, %s\n", errid)
+		fmt.Fprintf(b, "}\n")
+		return
+	}
+	if es.op == DECODE {
+		if es.zeroCopy {
+			es.alias()
+		}
+		es.getNewAlen()
+		nid := fmt.Sprintf("n%d", es.alenIdx)
+		fmt.Fprintf(b, "%s, err := %s.UnmarshalFromBytes(data[n:])\n", nid, fname)
+		fmt.Fprintf(b, "n += %s\n", nid)
+		fmt.Fprintf(b, "if err != nil {\n")
+		fmt.Fprintf(b, "return n, err\n")
+		fmt.Fprintf(b, "}\n")
+		return
+	}
+	fmt.Fprintf(b, "if err := %s.%s(wire); err != nil {\n", fname, funcname)
+	fmt.Fprintf(b, "return err\n")
+	fmt.Fprintf(b, "}\n")
+}
+
+// write outputs the byte slice data: to wire for Marshal, or onto the
+// end of dst for AppendBinary.
+func write(b io.Writer, data string, es *EmitState) {
+	if es.op == APPEND {
+		fmt.Fprintf(b, "dst = append(dst, %s...)\n", data)
+		return
+	}
+	writeCall(b, fmt.Sprintf("wire.Write(%s)", data))
+}
+
+// flushbs outputs a completed run.  AppendBinary already built it in place.
+func flushbs(b io.Writer, es *EmitState) {
+	if es.op != APPEND {
+		writeCall(b, "wire.Write(bs)")
 	}
-	ti, ok := typedb[tname]
+}
+
+// Marshal stops at the first failed write and returns its error.
+func writeCall(b io.Writer, call string) {
+	fmt.Fprintf(b, "if _, err := %s; err != nil {\n", call)
+	fmt.Fprintf(b, "return err\n")
+	fmt.Fprintf(b, "}\n")
+}
+
+func marshalField(b io.Writer, fname string, t ast.Expr, es *EmitState) {
+	ti, ok := es.g.basic(t)
 	if !ok {
-		fmt.Fprintf(b, "%s.Marshal(wire)\n", fname)
+		dispatch(b, fname, "Marshal", es)
+		return
+	}
+	if ti.EncodesAs == "string" {
+		marshalString(b, fname, es)
+		return
+	}
+	if es.tag.varint {
+		putVarint(b, fmt.Sprintf("int64(%s)", fname), false, es)
+		return
+	}
+	if es.tag.uvarint {
+		putVarint(b, fmt.Sprintf("uint64(%s)", fname), true, es)
 		return
 	}
 
@@ -119,7 +419,7 @@ func marshalField(b io.Writer, fname, tname string, es *EmitState) {
 	if found {
 		fmt.Fprintf(b, "%s\n", ilef(encodefrom, bstart, fname, es))
 	} else {
-		need_binary = true
+		es.g.need.binary = true
 		endian := "Little"
 		if es.bigEndian {
 			endian = "Big"
@@ -133,41 +433,450 @@ func marshalField(b io.Writer, fname, tname string, es *EmitState) {
 		}
 	}
 	if es.resetBuffer || (es.contiguous[es.crt] == es.staticOffset && es.staticOffset > 0) {
-		fmt.Fprintln(b, "wire.Write(bs)")
+		flushbs(b, es)
+	}
+	if es.contiguous[es.crt] == es.staticOffset && es.staticOffset > 0 {
+		es.crt++
+		es.staticOffset = 0
+	}
+}
+
+// Strings use the same varint length prefix as variable-length slices.
+func marshalString(b io.Writer, fname string, es *EmitState) {
+	alenid := es.getNewAlen()
+	marshalLen(b, alenid, fname, es)
+	if es.op == APPEND {
+		write(b, fmt.Sprintf("string(%s)", fname), es)
+	} else {
+		writeCall(b, fmt.Sprintf("io.WriteString(wire, string(%s))", fname))
+	}
+}
+
+func sizeField(b io.Writer, fname string, t ast.Expr, es *EmitState) {
+	ti, ok := es.g.basic(t)
+	if !ok {
+		dispatch(b, fname, "BinarySize", es)
+		return
+	}
+	if ti.EncodesAs == "string" {
+		fmt.Fprintf(b, "nbytes += %s + len(%s)\n", es.lenSize(fmt.Sprintf("len(%s)", fname)), fname)
+		return
+	}
+	if es.tag.uvarint {
+		es.g.need.bits = true
+		fmt.Fprintf(b, "nbytes += (bits.Len64(uint64(%s)|1) + 6) / 7\n", fname)
+		return
+	}
+	if es.tag.varint {
+		// The zig-zag encoding of the value.
+		es.g.need.bits = true
+		fmt.Fprintf(b, "nbytes += (bits.Len64(uint64(int64(%s))<<1^uint64(int64(%s)>>63)|1) + 6) / 7\n", fname, fname)
+		return
+	}
+	es.addSize(b, ti.Size)
+}
+
+// lenSize is the size of the length prefix that marshalLen writes for n.
+func (es *EmitState) lenSize(n string) string {
+	if es.tag.lenType != "" {
+		return strconv.Itoa(typedb[lenTypes[es.tag.lenType]].Size)
+	}
+	return es.varintLen(n)
+}
+
+// varintLen is the size of the varint that marshalLen writes for the
+// non-negative length n.
+func (es *EmitState) varintLen(n string) string {
+	es.g.need.bits = true
+	return fmt.Sprintf("(bits.Len64(uint64(%s)<<1|1)+6)/7", n)
+}
+
+// fixedSize reports the encoded size of t, if it is the same for all values.
+func (es *EmitState) fixedSize(t ast.Expr) (int, bool) {
+	if es.tag.varint || es.tag.uvarint {
+		return 0, false
 	}
+	info := es.g.analyze(&ast.Field{Type: t})
+	return info.size, !info.varLen && !info.mustDispatch
+}
+
+// Short strings are read into the scratch buffer so that the only
+// allocation is the string conversion itself; long ones a chunk at a time.
+func unmarshalString(b io.Writer, fname, tname string, es *EmitState) {
+	alenid := es.getNewAlen()
+	sbid := fmt.Sprintf("sb%d", es.alenIdx)
+	unmarshalLen(b, alenid, es)
+	if es.op == DECODE {
+		fmt.Fprintf(b, "if int64(len(data)-n) < %s {\n", alenid)
+		fmt.Fprintf(b, "return n, io.ErrUnexpectedEOF\n")
+		fmt.Fprintf(b, "}\n")
+		if es.zeroCopy {
+			es.g.need.unsafe = true
+			es.alias()
+			fmt.Fprintf(b, "if %s > 0 {\n", alenid)
+			fmt.Fprintf(b, "%s = %s(unsafe.String(&data[n], int(%s)))\n", fname, tname, alenid)
+			fmt.Fprintf(b, "} else {\n")
+			fmt.Fprintf(b, "%s = \"\"\n", fname)
+			fmt.Fprintf(b, "}\n")
+		} else {
+			fmt.Fprintf(b, "%s = %s(data[n : n+int(%s)])\n", fname, tname, alenid)
+		}
+		fmt.Fprintf(b, "n += int(%s)\n", alenid)
+		return
+	}
+	fmt.Fprintf(b, "var %s []byte\n", sbid)
+	es.usedB = true
+	fmt.Fprintf(b, "if %s <= int64(len(b)) {\n", alenid)
+	fmt.Fprintf(b, "%s = b[:0]\n", sbid)
+	fmt.Fprintf(b, "} else {\n")
+	hintid := fmt.Sprintf("hint%d", es.alenIdx)
+	readHint(b, hintid, alenid, strconv.Itoa(READCHUNK))
+	fmt.Fprintf(b, "%s = make([]byte, 0, %s)\n", sbid, hintid)
+	fmt.Fprintf(b, "}\n")
+	readLong(b, sbid, alenid, es)
+	fmt.Fprintf(b, "%s = %s(%s)\n", fname, tname, sbid)
+}
+
+// Lengths are varints unless the field's tag gives them a fixed width.
+func marshalLen(b io.Writer, alenid, fname string, es *EmitState) {
+	fmt.Fprintf(b, "%s := int64(len(%s))\n", alenid, fname)
+	limit := es.tag.max
+	if limit > 0 {
+		es.g.need.errors = true
+		fmt.Fprintf(b, "if %s > %d {\n", alenid, limit)
+		fmt.Fprintf(b, "%s\n", es.returnErr(fmt.Sprintf("errors.New(\"%s: length exceeds max=%d\")", fname, limit)))
+		fmt.Fprintf(b, "}\n")
+	}
+	if es.tag.lenType == "" {
+		putVarint(b, alenid, false, es)
+		return
+	}
+	ti := typedb[lenTypes[es.tag.lenType]]
+	if widest := uint64(1)<<(8*ti.Size) - 1; ti.Size < 8 && (limit == 0 || uint64(limit) > widest) {
+		es.g.need.errors = true
+		fmt.Fprintf(b, "if %s > %d {\n", alenid, widest)
+		fmt.Fprintf(b, "%s\n", es.returnErr(fmt.Sprintf("errors.New(\"%s: length exceeds %s\")", fname, es.tag.lenType)))
+		fmt.Fprintf(b, "}\n")
+	}
+	setbs(b, ti.Size, es)
+	fmt.Fprintf(b, "%s\n", inlineEncode[ti.EncodesAs]("bs", 0, alenid, es))
+	flushbs(b, es)
+}
+
+// putVarint outputs the int64 (or, if unsigned, uint64) value as a varint.
+func putVarint(b io.Writer, value string, unsigned bool, es *EmitState) {
+	es.g.need.binary = true
+	kind := "Varint"
+	if unsigned {
+		kind = "Uvarint"
+	}
+	if es.op == APPEND {
+		fmt.Fprintf(b, "dst = binary.Append%s(dst, %s)\n", kind, value)
+		return
+	}
+	fmt.Fprintf(b, "bs = b[:]\n")
+	es.curBSize = es.blen
+	es.usedB, es.usedBs = true, true
+	fmt.Fprintf(b, "if wlen := binary.Put%s(bs, %s); wlen >= 0 {\n", kind, value)
+	writeCall(b, "wire.Write(b[0:wlen])")
+	fmt.Fprintf(b, "}\n")
+}
+
+// readVarint declares id and reads a varint (or uvarint) into it.
+func readVarint(b io.Writer, id string, unsigned bool, es *EmitState) {
+	es.g.need.binary = true
+	kind := "Varint"
+	if unsigned {
+		kind = "Uvarint"
+	}
+	if es.op == DECODE {
+		es.g.need.errors = true
+		vnid := fmt.Sprintf("vn%d", es.alenIdx)
+		fmt.Fprintf(b, "%s, %s := binary.%s(data[n:])\n", id, vnid, kind)
+		fmt.Fprintf(b, "if %s == 0 {\n", vnid)
+		fmt.Fprintf(b, "return n, io.ErrUnexpectedEOF\n")
+		fmt.Fprintf(b, "} else if %s < 0 {\n", vnid)
+		fmt.Fprintf(b, "return n, errors.New(\"varint overflows a 64-bit integer\")\n")
+		fmt.Fprintf(b, "}\n")
+		fmt.Fprintf(b, "n += %s\n", vnid)
+	} else {
+		fmt.Fprintf(b, "%s, err := binary.Read%s(wire)\n", id, kind)
+		fmt.Fprintf(b, "if err != nil {\n")
+		fmt.Fprintf(b, "return err\n")
+		fmt.Fprintf(b, "}\n")
+	}
+}
+
+// A varint that doesn't fit in its field is an error, not truncated.
+func unmarshalVarint(b io.Writer, fname, tname string, ti TypeInfo, es *EmitState) {
+	es.getNewAlen()
+	vid := fmt.Sprintf("v%d", es.alenIdx)
+	readVarint(b, vid, es.tag.uvarint, es)
+	fmt.Fprintf(b, "%s = %s(%s)\n", fname, tname, vid)
+	if ti.Size < 8 {
+		es.g.need.errors = true
+		conv := "int64"
+		if es.tag.uvarint {
+			conv = "uint64"
+		}
+		fmt.Fprintf(b, "if %s(%s) != %s {\n", conv, fname, vid)
+		fmt.Fprintf(b, "%s\n", es.returnErr(fmt.Sprintf("errors.New(\"%s: varint overflows %s\")", fname, tname)))
+		fmt.Fprintf(b, "}\n")
+	}
+}
+
+// A negative length is an error rather than a panic in make.
+func unmarshalLen(b io.Writer, alenid string, es *EmitState) {
+	es.g.need.errors = true
+	if es.tag.lenType == "" {
+		readVarint(b, alenid, false, es)
+	} else {
+		ti := typedb[lenTypes[es.tag.lenType]]
+		readbs(b, ti.Size, es)
+		fmt.Fprintf(b, "%s := int64(%s)\n", alenid, inlineDecode[ti.EncodesAs]("bs", 0, es))
+	}
+	if es.tag.lenType == "" || es.tag.lenType == "u64" {
+		fmt.Fprintf(b, "if %s < 0 {\n", alenid)
+		fmt.Fprintf(b, "%s\n", es.returnErr("errors.New(\"negative length\")"))
+		fmt.Fprintf(b, "}\n")
+	}
+	if es.tag.max > 0 {
+		fmt.Fprintf(b, "if %s > %d {\n", alenid, es.tag.max)
+		fmt.Fprintf(b, "%s\n", es.returnErr(fmt.Sprintf("errors.New(\"%s: length exceeds max=%d\")", es.field, es.tag.max)))
+		fmt.Fprintf(b, "}\n")
+	}
+}
+
+// A byte array that is part of a contiguous run is copied into the run's
+// buffer; otherwise it is written directly.
+func marshalBytes(b io.Writer, fname string, n int, es *EmitState) {
+	if es.resetBuffer {
+		write(b, fname+"[:]", es)
+		return
+	}
+	bstart := es.Bstart(n)
+	if es.contiguous[es.crt] > 0 && bstart == 0 {
+		setbs(b, es.contiguous[es.crt], es)
+	}
+	fmt.Fprintf(b, "copy(bs[%d:%d], %s[:])\n", bstart, bstart+n, fname)
 	if es.contiguous[es.crt] == es.staticOffset && es.staticOffset > 0 {
+		flushbs(b, es)
 		es.crt++
 		es.staticOffset = 0
 	}
 }
 
-func walkContents(b io.Writer, st *ast.StructType, pred string, funcname string, fn func(io.Writer, string, string, *EmitState), es *EmitState) {
+func unmarshalBytes(b io.Writer, fname string, n int, es *EmitState) {
+	if es.resetBuffer {
+		readBytes(b, fname+"[:]", strconv.Itoa(n), es)
+		return
+	}
+	bstart := es.Bstart(n)
+	if es.contiguous[es.crt] > 0 && bstart == 0 {
+		readbs(b, es.contiguous[es.crt], es)
+	}
+	fmt.Fprintf(b, "copy(%s[:], bs[%d:%d])\n", fname, bstart, bstart+n)
+	if es.contiguous[es.crt] == es.staticOffset && es.staticOffset > 0 {
+		es.crt++
+		es.staticOffset = 0
+	}
+}
+
+func walkContents(b io.Writer, st *ast.StructType, pred string, funcname string, fn func(io.Writer, string, ast.Expr, *EmitState), es *EmitState) {
 	for _, f := range st.Fields.List {
+		tag := parseTag(f)
+		if tag.skip {
+			continue
+		}
 		for _, fNameEnt := range f.Names {
 			newpred := pred + "." + fNameEnt.Name
-			walkOne(b, f, newpred, funcname, fn, es)
+			if pred == "t" {
+				es.field = newpred
+			}
+			outer, bigEndian := es.tag, es.bigEndian
+			es.tag = tag
+			if tag.order != "" {
+				es.bigEndian = tag.order == "be"
+			}
+			func() {
+				defer inField(fNameEnt.Name)
+				walkOne(b, f, newpred, funcname, fn, es)
+			}()
+			es.tag, es.bigEndian = outer, bigEndian
 		}
 	}
 }
 
+// fieldTag holds the options of a `bin:"..."` struct tag.  They apply to
+// everything encoded for the field, such as each element of a slice.
+type fieldTag struct {
+	skip    bool   // "-": the field isn't encoded
+	order   string // "be" or "le" overrides the byte order
+	varint  bool   // Integers are varints
+	uvarint bool   // Unsigned integers are uvarints
+	lenType string // Length prefixes are u8, u16, u32 or u64, not varints
+	max     int    // Maximum length, or 0 for no limit
+}
+
+var lenTypes map[string]string = map[string]string{
+	"u8":  "uint8",
+	"u16": "uint16",
+	"u32": "uint32",
+	"u64": "uint64",
+}
+
+func fieldName(f *ast.Field) string {
+	if len(f.Names) > 0 {
+		return f.Names[0].Name
+	}
+	return types.ExprString(f.Type)
+}
+
+func parseTag(f *ast.Field) (tag fieldTag) {
+	if f.Tag == nil {
+		return
+	}
+	tags, err := strconv.Unquote(f.Tag.Value)
+	if err != nil {
+		fail(f.Tag, "bad struct tag %s", f.Tag.Value)
+	}
+	spec, ok := reflect.StructTag(tags).Lookup("bin")
+	if !ok {
+		return
+	}
+	if spec == "-" {
+		tag.skip = true
+		return
+	}
+	for _, opt := range strings.Split(spec, ",") {
+		switch {
+		case opt == "be" || opt == "le":
+			tag.order = opt
+		case opt == "varint":
+			tag.varint = true
+		case opt == "uvarint":
+			tag.uvarint = true
+		case strings.HasPrefix(opt, "len="):
+			tag.lenType = opt[len("len="):]
+			if _, ok := lenTypes[tag.lenType]; !ok {
+				fail(f.Tag, "bin tag len must be u8, u16, u32 or u64")
+			}
+		case strings.HasPrefix(opt, "max="):
+			n, err := strconv.Atoi(opt[len("max="):])
+			if err != nil || n <= 0 {
+				fail(f.Tag, "bin tag max must be a positive int")
+			}
+			tag.max = n
+		default:
+			fail(f.Tag, "unknown bin tag option %s", opt)
+		}
+	}
+	if tag.varint && tag.uvarint {
+		fail(f.Tag, "bin tag can't be both varint and uvarint")
+	}
+	return
+}
+
+// checkTag panics if tag asks for something that f's type doesn't have.
+func (g *generator) checkTag(f *ast.Field, tag fieldTag) {
+	hasLen := false
+	seen := make(map[string]bool)
+	var check func(t ast.Expr)
+	check = func(t ast.Expr) {
+		switch t := t.(type) {
+		case *ast.ArrayType:
+			hasLen = hasLen || t.Len == nil
+			check(t.Elt)
+		case *ast.StarExpr:
+			check(t.X)
+		case *ast.MapType:
+			hasLen = true
+			check(t.Key)
+			check(t.Value)
+		default:
+			if ts := g.inlined(t); ts != nil {
+				if !seen[ts.Name.Name] {
+					seen[ts.Name.Name] = true
+					check(ts.Type)
+				}
+				return
+			}
+			ti, basic := g.basic(t)
+			isString := ti.EncodesAs == "string"
+			hasLen = hasLen || isString
+			wideInt := ti.EncodesAs == "uint16" || ti.EncodesAs == "uint32" || ti.EncodesAs == "uint64"
+			if tag.order != "" && !basic {
+				fail(f.Tag, "bin tag %s doesn't apply to %s", tag.order, types.ExprString(t))
+			}
+			if tag.varint && !isString && !wideInt {
+				fail(f.Tag, "bin tag varint needs integers wider than a byte, not %s", types.ExprString(t))
+			}
+			if tag.uvarint && !isString && !(wideInt && strings.HasPrefix(ti.Name, "uint")) {
+				fail(f.Tag, "bin tag uvarint needs unsigned integers wider than a byte, not %s", types.ExprString(t))
+			}
+		}
+	}
+	check(f.Type)
+	if (tag.lenType != "" || tag.max > 0) && !hasLen {
+		fail(f.Tag, "bin tag len and max need a slice, string or map")
+	}
+}
+
 const (
 	MARSHAL = iota
 	UNMARSHAL
+	APPEND // Marshal into a byte slice
+	DECODE // Unmarshal from a byte slice
+	SIZE   // Compute the encoded size
 )
 
 type EmitState struct {
-	op				int // MARSHAL, UNMARSHAL
-	nextIdx			int
-	staticOffset	int
-	alenIdx			int
-	curBSize		int
-    blen            int
-	bigEndian		bool // TODO:  This is duplicated now... integrate better.
-	tmp32exists		bool
-	tmp64exists		bool
-	contiguous		[]int
-	crt				int
-	resetBuffer		bool
+	g            *generator
+	op           int // MARSHAL, UNMARSHAL, APPEND, DECODE, SIZE
+	nextIdx      int
+	staticOffset int
+	alenIdx      int
+	curBSize     int
+	blen         int
+	bigEndian    bool // TODO:  This is duplicated now... integrate better.
+	strict       bool
+	sortKeys     bool
+	zeroCopy     bool
+	field        string   // Top-level field being emitted
+	aliased      []string // Fields that point into the input
+	tmp32exists  bool
+	tmp64exists  bool
+	contiguous   []int
+	crt          int
+	resetBuffer  bool
+	usedB        bool // The scratch buffer b is used
+	usedBs       bool
+	size         int             // Statically known part of the size, for SIZE
+	tag          fieldTag        // Tag of the field being emitted
+	inlining     map[string]bool // Types being encoded inline
+}
+
+func (es *EmitState) decoding() bool {
+	return es.op == UNMARSHAL || es.op == DECODE
+}
+
+// returnErr is the statement returning err from the function being emitted.
+func (es *EmitState) returnErr(err string) string {
+	if es.op == DECODE {
+		return "return n, " + err
+	}
+	if es.op == APPEND {
+		return "return dst, " + err
+	}
+	return "return " + err
+}
+
+// alias records that the field being emitted shares memory with the input.
+func (es *EmitState) alias() {
+	n := len(es.aliased)
+	if n == 0 || es.aliased[n-1] != es.field {
+		es.aliased = append(es.aliased, es.field)
+	}
 }
 
 func (es *EmitState) getNewAlen() string {
@@ -187,17 +896,44 @@ func (es *EmitState) freeIndexStr() {
 	es.nextIdx--
 }
 
+// Temporaries declared inside a loop body go out of scope with it, and
+// the length of bs depends on how many times the loop ran; call the
+// returned func when closing the block.
+func (es *EmitState) openBlock() func() {
+	tmp32, tmp64 := es.tmp32exists, es.tmp64exists
+	es.curBSize = -1
+	return func() {
+		es.tmp32exists, es.tmp64exists = tmp32, tmp64
+		es.curBSize = -1
+	}
+}
+
+// addSize counts n bytes towards the size: statically, unless we are
+// inside a loop or conditional.
+func (es *EmitState) addSize(b io.Writer, n int) {
+	if es.resetBuffer {
+		fmt.Fprintf(b, "nbytes += %d\n", n)
+	} else {
+		es.size += n
+	}
+}
+
+// The len and max tag options are for the field's own length, not those
+// of its elements; call the returned func when done with the elements.
+func (es *EmitState) elements() func() {
+	outer := es.tag
+	es.tag.lenType, es.tag.max = "", 0
+	return func() {
+		es.tag = outer
+	}
+}
+
 func (es *EmitState) Bstart(n int) int {
 	o := es.staticOffset
 	es.staticOffset += n
 	return o
 }
 
-var need_bufio = false
-var need_binary = false
-
-var typemap map[string]string = make(map[string]string)
-
 type TypeInfo struct {
 	Name      string
 	Size      int
@@ -216,6 +952,10 @@ func ilByteOut(b string, offset int, target string, es *EmitState) string {
 	return fmt.Sprintf("%s[%d] = byte(%s)", b, offset, target)
 }
 
+func ilBoolOut(b string, offset int, target string, es *EmitState) string {
+	return fmt.Sprintf("if %s {\n%s[%d] = 1\n} else {\n%s[%d] = 0\n}", target, b, offset, b, offset)
+}
+
 func ilUint16Out(b string, offset int, target string, es *EmitState) string {
 	if !es.bigEndian {
 		return fmt.Sprintf("%s[%d] = byte(%s)\n%s[%d] = byte(%s >> 8)",
@@ -228,10 +968,10 @@ func ilUint16Out(b string, offset int, target string, es *EmitState) string {
 func ilUint32Out(b string, offset int, target string, es *EmitState) string {
 	tmp32 := ""
 	if !es.tmp32exists {
-		tmp32 = fmt.Sprintf("tmp32 := %s\n", target)
+		tmp32 = fmt.Sprintf("tmp32 := uint32(%s)\n", target)
 		es.tmp32exists = true
 	} else {
-		tmp32 = fmt.Sprintf("tmp32 = %s\n", target)
+		tmp32 = fmt.Sprintf("tmp32 = uint32(%s)\n", target)
 	}
 	target = "tmp32"
 	if !es.bigEndian {
@@ -245,10 +985,10 @@ func ilUint32Out(b string, offset int, target string, es *EmitState) string {
 func ilUint64Out(b string, offset int, target string, es *EmitState) string {
 	tmp64 := ""
 	if !es.tmp64exists {
-		tmp64 = fmt.Sprintf("tmp64 := %s\n", target)
+		tmp64 = fmt.Sprintf("tmp64 := uint64(%s)\n", target)
 		es.tmp64exists = true
 	} else {
-		tmp64 = fmt.Sprintf("tmp64 = %s\n", target)
+		tmp64 = fmt.Sprintf("tmp64 = uint64(%s)\n", target)
 	}
 	target = "tmp64"
 	if !es.bigEndian {
@@ -259,12 +999,38 @@ func ilUint64Out(b string, offset int, target string, es *EmitState) string {
 		tmp64, b, offset, target, b, offset+1, target, b, offset+2, target, b, offset+3, target, b, offset+4, target, b, offset+5, target, b, offset+6, target, b, offset+7, target)
 }
 
+// Floats go out as their IEEE-754 bits, exactly as binary.Write does.
+// Complex numbers are the real part followed by the imaginary part.
+func ilFloat32Out(b string, offset int, target string, es *EmitState) string {
+	es.g.need.math = true
+	return ilUint32Out(b, offset, fmt.Sprintf("math.Float32bits(float32(%s))", target), es)
+}
+
+func ilFloat64Out(b string, offset int, target string, es *EmitState) string {
+	es.g.need.math = true
+	return ilUint64Out(b, offset, fmt.Sprintf("math.Float64bits(float64(%s))", target), es)
+}
+
+func ilComplex64Out(b string, offset int, target string, es *EmitState) string {
+	return ilFloat32Out(b, offset, fmt.Sprintf("real(%s)", target), es) + "\n" +
+		ilFloat32Out(b, offset+4, fmt.Sprintf("imag(%s)", target), es)
+}
+
+func ilComplex128Out(b string, offset int, target string, es *EmitState) string {
+	return ilFloat64Out(b, offset, fmt.Sprintf("real(%s)", target), es) + "\n" +
+		ilFloat64Out(b, offset+8, fmt.Sprintf("imag(%s)", target), es)
+}
 
 var inlineEncode map[string]encodefunc = map[string]encodefunc{
-	"byte":   ilByteOut,
-	"uint16": ilUint16Out,
-	"uint32": ilUint32Out,
-    "uint64": ilUint64Out,
+	"byte":       ilByteOut,
+	"bool":       ilBoolOut,
+	"uint16":     ilUint16Out,
+	"uint32":     ilUint32Out,
+	"uint64":     ilUint64Out,
+	"float32":    ilFloat32Out,
+	"float64":    ilFloat64Out,
+	"complex64":  ilComplex64Out,
+	"complex128": ilComplex128Out,
 }
 
 type decodefunc func(string, int, *EmitState) string
@@ -273,6 +1039,10 @@ func ilByte(b string, offset int, es *EmitState) string {
 	return fmt.Sprintf("%s[%d]", b, offset)
 }
 
+func ilBool(b string, offset int, es *EmitState) string {
+	return fmt.Sprintf("%s[%d] != 0", b, offset)
+}
+
 func ilUint16(b string, offset int, es *EmitState) string {
 	if es.bigEndian {
 		return fmt.Sprintf("((uint16(%s[%d]) << 8) | uint16(%s[%d]))", b, offset, b, offset+1)
@@ -294,12 +1064,34 @@ func ilUint64(b string, offset int, es *EmitState) string {
 	return fmt.Sprintf("(uint64(%s[%d]) | (uint64(%s[%d]) << 8)  | (uint64(%s[%d]) << 16) | (uint64(%s[%d]) << 24) | (uint64(%s[%d]) << 32) | (uint64(%s[%d]) << 40)  | (uint64(%s[%d]) << 48) | (uint64(%s[%d]) << 56))", b, offset, b, offset+1, b, offset+2, b, offset+3, b, offset+4, b, offset+5, b, offset+6, b, offset+7)
 }
 
+func ilFloat32(b string, offset int, es *EmitState) string {
+	es.g.need.math = true
+	return fmt.Sprintf("math.Float32frombits(%s)", ilUint32(b, offset, es))
+}
+
+func ilFloat64(b string, offset int, es *EmitState) string {
+	es.g.need.math = true
+	return fmt.Sprintf("math.Float64frombits(%s)", ilUint64(b, offset, es))
+}
+
+func ilComplex64(b string, offset int, es *EmitState) string {
+	return fmt.Sprintf("complex(%s, %s)", ilFloat32(b, offset, es), ilFloat32(b, offset+4, es))
+}
+
+func ilComplex128(b string, offset int, es *EmitState) string {
+	return fmt.Sprintf("complex(%s, %s)", ilFloat64(b, offset, es), ilFloat64(b, offset+8, es))
+}
 
 var inlineDecode map[string]decodefunc = map[string]decodefunc{
-	"byte":   ilByte,
-	"uint16": ilUint16,
-	"uint32": ilUint32,
-	"uint64": ilUint64,
+	"byte":       ilByte,
+	"bool":       ilBool,
+	"uint16":     ilUint16,
+	"uint32":     ilUint32,
+	"uint64":     ilUint64,
+	"float32":    ilFloat32,
+	"float64":    ilFloat64,
+	"complex64":  ilComplex64,
+	"complex128": ilComplex128,
 }
 
 var decodeFunc map[string]string = map[string]string{
@@ -309,79 +1101,163 @@ var decodeFunc map[string]string = map[string]string{
 }
 
 var typedb map[string]TypeInfo = map[string]TypeInfo{
-	"int":    {"int", 8, "uint64"},
-	"uint64": {"uint64", 8, "uint64"},
-	"int64":  {"int64", 8, "uint64"},
-	"int32":  {"int32", 4, "uint32"},
-	"uint32": {"uint32", 4, "uint32"},
-	"int16":  {"int16", 2, "uint16"},
-	"uint16": {"uint16", 2, "uint16"},
-	"int8":   {"int8", 1, "byte"},
-	"uint8":  {"uint8", 1, "byte"},
-	"byte":   {"byte", 1, "byte"},
-}
-
-func walkOne(b io.Writer, f *ast.Field, pred string, funcname string, fn func(io.Writer, string, string, *EmitState), es *EmitState) {
-	switch f.Type.(type) {
-	case *ast.Ident:
-		t := f.Type.(*ast.Ident)
-		_, is_mapped := typemap[t.Name]
-		_, simple := simpleStructMap[t.Name]
+	"int":        {"int", 8, "uint64"},
+	"uint64":     {"uint64", 8, "uint64"},
+	"int64":      {"int64", 8, "uint64"},
+	"int32":      {"int32", 4, "uint32"},
+	"uint32":     {"uint32", 4, "uint32"},
+	"int16":      {"int16", 2, "uint16"},
+	"uint16":     {"uint16", 2, "uint16"},
+	"int8":       {"int8", 1, "byte"},
+	"uint8":      {"uint8", 1, "byte"},
+	"byte":       {"byte", 1, "byte"},
+	"bool":       {"bool", 1, "bool"},
+	"string":     {"string", 0, "string"},
+	"float32":    {"float32", 4, "float32"},
+	"float64":    {"float64", 8, "float64"},
+	"complex64":  {"complex64", 8, "complex64"},
+	"complex128": {"complex128", 16, "complex128"},
+}
 
-		if dispatchTo, ok := globalDeclMap[t.Name]; !is_mapped && ok && simple {
-			if strucType, ok := dispatchTo.Type.(*ast.StructType); ok {
-				walkContents(b, strucType, pred, funcname, fn, es)
-			} else {
-				panic("Eek, a type I don't handle properly")
+func walkOne(b io.Writer, f *ast.Field, pred string, funcname string, fn func(io.Writer, string, ast.Expr, *EmitState), es *EmitState) {
+	switch f.Type.(type) {
+	case *ast.Ident, *ast.SelectorExpr:
+		// Fixed-size structs of ours are encoded inline, and so are our
+		// arrays, slices and maps.
+		if ts := es.g.inlined(f.Type); ts != nil && !es.inlining[ts.Name.Name] {
+			if es.inlining == nil {
+				es.inlining = make(map[string]bool)
 			}
+			es.inlining[ts.Name.Name] = true
+			walkOne(b, &ast.Field{Type: ts.Type}, pred, funcname, fn, es)
+			delete(es.inlining, ts.Name.Name)
+		} else if ts != nil {
+			// A recursive type dispatches to its own methods.
+			fn(b, pred, f.Type, es)
+		} else if ts := es.g.decl(f.Type); ts != nil && es.g.simpleStructMap[ts.Name.Name] != nil {
+			walkContents(b, es.g.structOf(ts.Type), pred, funcname, fn, es)
 		} else {
-			fn(b, pred, t.Name, es)
+			fn(b, pred, f.Type, es)
 		}
-	case *ast.SelectorExpr:
-		fmt.Fprintf(b, "%s.%s(wire)\n", pred, funcname)
 	case *ast.ArrayType:
 		s := f.Type.(*ast.ArrayType)
 		i := es.getIndexStr()
 		arrayLen := 0
 		alenid := es.getNewAlen()
 		if s.Len == nil {
+			if es.op == SIZE {
+				fmt.Fprintf(b, "nbytes += %s\n", es.lenSize(fmt.Sprintf("len(%s)", pred)))
+				if n, ok := es.fixedSize(s.Elt); ok {
+					if n == 1 {
+						fmt.Fprintf(b, "nbytes += len(%s)\n", pred)
+					} else if n > 0 {
+						fmt.Fprintf(b, "nbytes += len(%s) * %d\n", pred, n)
+					}
+					es.freeIndexStr()
+					return
+				}
+				fmt.Fprintf(b, "for %s := range %s {\n", i, pred)
+				closeElements := es.elements()
+				reset := es.resetBuffer
+				es.resetBuffer = true
+				walkOne(b, &ast.Field{Type: s.Elt}, fmt.Sprintf("%s[%s]", pred, i), funcname, fn, es)
+				es.resetBuffer = reset
+				closeElements()
+				fmt.Fprintln(b, "}")
+				es.freeIndexStr()
+				return
+			}
 			// If we are unmarshaling we need to allocate.
-			need_binary = true
-			if es.op == UNMARSHAL {
-				fmt.Fprintf(b, "%s, err := binary.ReadVarint(wire)\n", alenid)
-				fmt.Fprintf(b, "if err != nil {\n")
-				fmt.Fprintf(b, "return err\n")
-				fmt.Fprintf(b, "}\n")
-                if se, ok := s.Elt.(*ast.SelectorExpr); ok {
-                    fmt.Fprintf(b, "%s = make([]%s.%s, %s)\n", pred, se.X, se.Sel, alenid)
-                } else {
-                    fmt.Fprintf(b, "%s = make([]%s, %s)\n", pred, s.Elt, alenid)
-                }
+			if es.decoding() {
+				unmarshalLen(b, alenid, es)
+				if es.op == DECODE {
+					// Don't allocate for more elements than the rest of
+					// the input can hold.
+					emin, _, _ := es.g.sizeBounds(s.Elt, es.tag.elements(), make(map[string]bool))
+					if es.g.isByte(s.Elt) {
+						emin = 1
+					}
+					switch {
+					case emin == 1:
+						fmt.Fprintf(b, "if %s > int64(len(data)-n) {\n", alenid)
+					case emin > 1:
+						fmt.Fprintf(b, "if %s > int64(len(data)-n)/%d {\n", alenid, emin)
+					}
+					if emin > 0 {
+						fmt.Fprintf(b, "return n, io.ErrUnexpectedEOF\n")
+						fmt.Fprintf(b, "}\n")
+					}
+				}
+				if es.op == DECODE && es.zeroCopy && es.g.isByte(s.Elt) {
+					// The capacity is clipped so that appending to the
+					// field can't overwrite the rest of the input.
+					es.alias()
+					fmt.Fprintf(b, "%s = data[n : n+int(%s) : n+int(%s)]\n", pred, alenid, alenid)
+					fmt.Fprintf(b, "n += int(%s)\n", alenid)
+					es.freeIndexStr()
+					return
+				}
+				if es.op == DECODE {
+					fmt.Fprintf(b, "%s = make([]%s, %s)\n", pred, es.g.typeString(s.Elt), alenid)
+				} else {
+					// A stream can claim any length, so the slice grows
+					// as its elements arrive.
+					hintid := fmt.Sprintf("hint%d", es.alenIdx)
+					limit := MAPHINTMAX
+					if es.g.isByte(s.Elt) {
+						limit = READCHUNK
+					}
+					readHint(b, hintid, alenid, strconv.Itoa(limit))
+					fmt.Fprintf(b, "%s = make([]%s, 0, %s)\n", pred, es.g.typeString(s.Elt), hintid)
+				}
 			} else {
-				//setbs(b, 10, es, false)
-				fmt.Fprintf(b, "bs = b[:]\n")
-                es.curBSize = es.blen
-				fmt.Fprintf(b, "%s := int64(len(%s))\n", alenid, pred)
-				fmt.Fprintf(b, "if wlen := binary.PutVarint(bs, %s); wlen >= 0 {\n", alenid)
-				fmt.Fprintf(b, "wire.Write(b[0:wlen])\n")
-				fmt.Fprintf(b, "}\n")
+				marshalLen(b, alenid, pred, es)
+			}
+			if es.g.isByte(s.Elt) {
+				if es.op == DECODE {
+					readBytes(b, pred, alenid, es)
+				} else if es.op == UNMARSHAL {
+					readLong(b, pred, alenid, es)
+				} else {
+					write(b, pred, es)
+				}
+				es.freeIndexStr()
+				return
+			}
+			zeroid := fmt.Sprintf("zero%d", es.alenIdx)
+			if es.op == UNMARSHAL {
+				fmt.Fprintf(b, "var %s %s\n", zeroid, es.g.typeString(s.Elt))
 			}
 			fmt.Fprintf(b, "for %s := int64(0); %s < %s; %s++ {\n", i, i, alenid, i)
+			if es.op == UNMARSHAL {
+				fmt.Fprintf(b, "%s = append(%s, %s)\n", pred, pred, zeroid)
+			}
+			closeBlock := es.openBlock()
+			closeElements := es.elements()
 			fsub := fmt.Sprintf("%s[%s]", pred, i)
 			pseudofield := &ast.Field{Type: s.Elt}
+			reset := es.resetBuffer
 			es.resetBuffer = true
 			walkOne(b, pseudofield, fsub, funcname, fn, es)
-			es.resetBuffer = false
+			es.resetBuffer = reset
+			closeElements()
+			closeBlock()
 			fmt.Fprintln(b, "}")
 		} else {
-			e, ok := s.Len.(*ast.BasicLit)
-			if !ok {
-				panic("Bad literal in array decl")
+			arrayLen = es.g.arrayLength(s)
+			if n, ok := es.fixedSize(s); ok && es.op == SIZE {
+				es.addSize(b, n)
+				es.freeIndexStr()
+				return
 			}
-			var err error
-			arrayLen, err = strconv.Atoi(e.Value)
-			if err != nil {
-				panic("Bad array length value.  Must be a simple int.")
+			if es.g.isByte(s.Elt) {
+				if es.decoding() {
+					unmarshalBytes(b, pred, arrayLen, es)
+				} else {
+					marshalBytes(b, pred, arrayLen, es)
+				}
+				es.freeIndexStr()
+				return
 			}
 			pseudofield := &ast.Field{Type: s.Elt}
 			for idx := 0; idx < arrayLen; idx++ {
@@ -390,24 +1266,170 @@ func walkOne(b io.Writer, f *ast.Field, pred string, funcname string, fn func(io
 			}
 		}
 		es.freeIndexStr()
+	case *ast.MapType:
+		walkMap(b, f.Type.(*ast.MapType), pred, funcname, fn, es)
+	case *ast.StarExpr:
+		walkPointer(b, f.Type.(*ast.StarExpr), pred, funcname, fn, es)
 	default:
-		fmt.Println("Unknown type: ", f)
-		panic("Unknown type in struct")
+		fail(f.Type, "can't encode %s", types.ExprString(f.Type))
 	}
 }
 
-type StructInfo struct {
-	size			int
-	maxSize			int
-	maxContiguous	int
-	contiguous		[]int
-	varLen			bool
-	mustDispatch	bool
-	totalSize		int // Including embedded types, if known
+// Pointers are a presence byte, 0 for nil or 1, followed by the pointee.
+// Unmarshal reuses an existing pointee rather than allocating a new one.
+func walkPointer(b io.Writer, p *ast.StarExpr, pred string, funcname string, fn func(io.Writer, string, ast.Expr, *EmitState), es *EmitState) {
+	if es.op == SIZE {
+		es.addSize(b, 1)
+		fmt.Fprintf(b, "if %s != nil {\n", pred)
+	} else if es.decoding() {
+		readbs(b, 1, es)
+		if es.strict {
+			es.g.need.errors = true
+			fmt.Fprintf(b, "if bs[0] > 1 {\n")
+			fmt.Fprintf(b, "%s\n", es.returnErr(fmt.Sprintf("errors.New(\"%s: invalid presence byte\")", pred)))
+			fmt.Fprintf(b, "}\n")
+		}
+		fmt.Fprintf(b, "if bs[0] == 0 {\n")
+		fmt.Fprintf(b, "%s = nil\n", pred)
+		fmt.Fprintf(b, "} else {\n")
+		fmt.Fprintf(b, "if %s == nil {\n", pred)
+		fmt.Fprintf(b, "%s = new(%s)\n", pred, es.g.typeString(p.X))
+		fmt.Fprintf(b, "}\n")
+	} else {
+		setbs(b, 1, es)
+		fmt.Fprintf(b, "if %s == nil {\n", pred)
+		fmt.Fprintf(b, "bs[0] = 0\n")
+		flushbs(b, es)
+		fmt.Fprintf(b, "} else {\n")
+		fmt.Fprintf(b, "bs[0] = 1\n")
+		flushbs(b, es)
+	}
+	closeBlock := es.openBlock()
+	reset := es.resetBuffer
+	es.resetBuffer = true
+	walkOne(b, &ast.Field{Type: p.X}, "(*"+pred+")", funcname, fn, es)
+	es.resetBuffer = reset
+	closeBlock()
+	fmt.Fprintln(b, "}")
 }
 
-var structInfoMap map[string]*StructInfo
-var simpleStructMap map[string]*StructInfo
+// Maps are a varint count followed by key, value pairs.
+func walkMap(b io.Writer, m *ast.MapType, pred string, funcname string, fn func(io.Writer, string, ast.Expr, *EmitState), es *EmitState) {
+	alenid := es.getNewAlen()
+	kid := fmt.Sprintf("mk%d", es.alenIdx)
+	vid := fmt.Sprintf("mv%d", es.alenIdx)
+	ktype := es.g.typeString(m.Key)
+	vtype := es.g.typeString(m.Value)
+	if es.decoding() {
+		i := es.getIndexStr()
+		unmarshalLen(b, alenid, es)
+		// The count comes from the input, so don't trust it with memory.
+		hintid := fmt.Sprintf("hint%d", es.alenIdx)
+		limit := strconv.Itoa(MAPHINTMAX)
+		if es.op == DECODE {
+			limit = "int64(len(data)-n)"
+		}
+		readHint(b, hintid, alenid, limit)
+		fmt.Fprintf(b, "%s = make(map[%s]%s, %s)\n", pred, ktype, vtype, hintid)
+		fmt.Fprintf(b, "for %s := int64(0); %s < %s; %s++ {\n", i, i, alenid, i)
+		fmt.Fprintf(b, "var %s %s\n", kid, ktype)
+		fmt.Fprintf(b, "var %s %s\n", vid, vtype)
+		walkMapEntry(b, m, kid, vid, funcname, fn, es)
+		if es.strict {
+			es.g.need.errors = true
+			fmt.Fprintf(b, "if _, dup := %s[%s]; dup {\n", pred, kid)
+			fmt.Fprintf(b, "%s\n", es.returnErr(fmt.Sprintf("errors.New(\"%s: duplicate map key\")", pred)))
+			fmt.Fprintf(b, "}\n")
+		}
+		fmt.Fprintf(b, "%s[%s] = %s\n", pred, kid, vid)
+		fmt.Fprintln(b, "}")
+		es.freeIndexStr()
+		return
+	}
+
+	if es.op == SIZE {
+		fmt.Fprintf(b, "nbytes += %s\n", es.lenSize(fmt.Sprintf("len(%s)", pred)))
+		ksize, kfixed := es.fixedSize(m.Key)
+		vsize, vfixed := es.fixedSize(m.Value)
+		if kfixed && vfixed {
+			if ksize+vsize > 0 {
+				fmt.Fprintf(b, "nbytes += len(%s) * %d\n", pred, ksize+vsize)
+			}
+			return
+		}
+		// Fixed-size entries don't mention their variable.
+		if kfixed {
+			kid = "_"
+		}
+		if vfixed {
+			fmt.Fprintf(b, "for %s := range %s {\n", kid, pred)
+		} else {
+			fmt.Fprintf(b, "for %s, %s := range %s {\n", kid, vid, pred)
+		}
+		walkMapEntry(b, m, kid, vid, funcname, fn, es)
+		fmt.Fprintln(b, "}")
+		return
+	}
+
+	marshalLen(b, alenid, pred, es)
+	if !es.sortKeys {
+		fmt.Fprintf(b, "for %s, %s := range %s {\n", kid, vid, pred)
+	} else {
+		es.g.need.sort = true
+		keysid := fmt.Sprintf("keys%d", es.alenIdx)
+		fmt.Fprintf(b, "%s := make([]%s, 0, %s)\n", keysid, ktype, alenid)
+		fmt.Fprintf(b, "for %s := range %s {\n", kid, pred)
+		fmt.Fprintf(b, "%s = append(%s, %s)\n", keysid, keysid, kid)
+		fmt.Fprintf(b, "}\n")
+		fmt.Fprintf(b, "sort.Slice(%s, func(x, y int) bool {\n", keysid)
+		fmt.Fprintf(b, "return %s\n", es.g.keyLess(m.Key, keysid+"[x]", keysid+"[y]"))
+		fmt.Fprintf(b, "})\n")
+		fmt.Fprintf(b, "for _, %s := range %s {\n", kid, keysid)
+		fmt.Fprintf(b, "%s := %s[%s]\n", vid, pred, kid)
+	}
+	walkMapEntry(b, m, kid, vid, funcname, fn, es)
+	fmt.Fprintln(b, "}")
+}
+
+func walkMapEntry(b io.Writer, m *ast.MapType, kid, vid string, funcname string, fn func(io.Writer, string, ast.Expr, *EmitState), es *EmitState) {
+	closeBlock := es.openBlock()
+	closeElements := es.elements()
+	reset := es.resetBuffer
+	es.resetBuffer = true
+	// Keys never point into the input: changing it would corrupt the map.
+	zeroCopy := es.zeroCopy
+	es.zeroCopy = false
+	walkOne(b, &ast.Field{Type: m.Key}, kid, funcname, fn, es)
+	es.zeroCopy = zeroCopy
+	walkOne(b, &ast.Field{Type: m.Value}, vid, funcname, fn, es)
+	es.resetBuffer = reset
+	closeElements()
+	closeBlock()
+}
+
+// keyLess returns an expression ordering two map keys.  Only keys of
+// basic types can be sorted.
+func (g *generator) keyLess(key ast.Expr, x, y string) string {
+	ti, ok := g.basic(key)
+	if !ok || ti.EncodesAs == "complex64" || ti.EncodesAs == "complex128" {
+		fail(key, "can't sort map keys of type %s", types.ExprString(key))
+	}
+	if ti.EncodesAs == "bool" {
+		return fmt.Sprintf("!%s && %s", x, y)
+	}
+	return fmt.Sprintf("%s < %s", x, y)
+}
+
+type StructInfo struct {
+	size          int
+	maxSize       int
+	maxContiguous int
+	contiguous    []int
+	varLen        bool
+	hasString     bool
+	mustDispatch  bool
+	totalSize     int // Including embedded types, if known
+}
 
 func mergeInfo(parent, child *StructInfo, childcount int) {
 	crt := len(parent.contiguous) - 1
@@ -427,6 +1449,7 @@ func mergeInfo(parent, child *StructInfo, childcount int) {
 		parent.maxSize = child.maxSize
 	}
 	parent.varLen = parent.varLen || child.varLen
+	parent.hasString = parent.hasString || child.hasString
 	parent.mustDispatch = parent.mustDispatch || child.mustDispatch
 
 	if childcount > 0 {
@@ -437,63 +1460,98 @@ func mergeInfo(parent, child *StructInfo, childcount int) {
 }
 
 // Wouldn't it be nice to cache a lot of this? :-)
-func analyze(n interface{}) (info *StructInfo) {
+func (g *generator) analyze(n interface{}) (info *StructInfo) {
 	info = new(StructInfo)
 	info.contiguous = make([]int, 1)
 	switch n.(type) {
 	case *ast.StructType:
 		st := n.(*ast.StructType)
 		for _, field := range st.Fields.List {
-			for _ = range field.Names {
-				mergeInfo(info, analyze(field), 1)
-			}
+			func() {
+				defer g.record(fieldName(field))
+				tag := parseTag(field)
+				if tag.skip {
+					return
+				}
+				finfo := g.analyze(field)
+				g.checkTag(field, tag)
+				if tag.varint || tag.uvarint {
+					// Like a string, there is no fixed-size part.
+					finfo = &StructInfo{varLen: true, hasString: finfo.hasString, contiguous: make([]int, 1)}
+					g.need.bufio = true
+				}
+				for range field.Names {
+					mergeInfo(info, finfo, 1)
+				}
+			}()
 		}
 	case *ast.Field:
 		f := n.(*ast.Field)
 		switch f.Type.(type) {
-		case *ast.Ident:
-			tname := f.Type.(*ast.Ident).Name
-			if mapped, ok := typemap[tname]; ok {
-				tname = mapped
-			}
-			if tinfo, ok := typedb[tname]; ok {
+		case *ast.Ident, *ast.SelectorExpr:
+			if tinfo, ok := g.basic(f.Type); ok {
 				info.maxSize = tinfo.Size
 				info.size = tinfo.Size
-			} else {
-				seinfo := analyzeType(tname)
-				if seinfo != nil && seinfo.mustDispatch == false && seinfo.varLen == false {
+				if tinfo.EncodesAs == "string" {
+					info.varLen = true
+					info.hasString = true
+					g.need.bufio = true
+				}
+			} else if _, ok := g.typeOf(f.Type).Underlying().(*types.Basic); ok {
+				fail(f.Type, "can't encode %s", types.ExprString(f.Type))
+			} else if ts := g.inlined(f.Type); ts != nil && g.analyzing[ts.Name.Name] {
+				// A recursive type, like type L []L, which dispatches to
+				// its own methods.
+				info.mustDispatch = true
+			} else if ts != nil {
+				g.analyzing[ts.Name.Name] = true
+				defer delete(g.analyzing, ts.Name.Name)
+				return g.analyze(&ast.Field{Type: ts.Type})
+			} else if ts := g.decl(f.Type); ts != nil && g.analyzing[ts.Name.Name] {
+				// Reached through a pointer, slice or map of its own.
+				info.mustDispatch = true
+			} else if ts != nil && g.structOf(ts.Type) != nil {
+				seinfo := g.analyzeType(ts)
+				if seinfo.mustDispatch == false && seinfo.varLen == false {
 					mergeInfo(info, seinfo, 1)
-					simpleStructMap[tname] = seinfo
+					g.simpleStructMap[ts.Name.Name] = seinfo
 				} else {
 					info.mustDispatch = true
 				}
+			} else {
+				g.checkMethods(f.Type)
+				info.mustDispatch = true
 			}
-		case *ast.SelectorExpr:
-			info.mustDispatch = true
 		case *ast.ArrayType:
 			s := f.Type.(*ast.ArrayType)
 			arraylen := 0
 			if s.Len == nil {
 				// If we are unmarshaling we need to allocate.
 				info.varLen = true
-				need_bufio = true // eventually just in info
+				g.need.bufio = true // eventually just in info
 			} else {
-				e, ok := s.Len.(*ast.BasicLit)
-				if !ok {
-					panic("Bad literal in array decl")
-				}
-				var err error
-				arraylen, err = strconv.Atoi(e.Value)
-				if err != nil {
-					panic("Bad array length value.  Must be a simple int.")
-				}
+				arraylen = g.arrayLength(s)
 			}
 
 			pseudofield := &ast.Field{Type: s.Elt}
-			mergeInfo(info, analyze(pseudofield), arraylen)
+			mergeInfo(info, g.analyze(pseudofield), arraylen)
+		case *ast.StarExpr:
+			info.varLen = true
+			g.need.bufio = true
+			pinfo := g.analyze(&ast.Field{Type: f.Type.(*ast.StarExpr).X})
+			info.hasString = pinfo.hasString
+			info.mustDispatch = pinfo.mustDispatch
+		case *ast.MapType:
+			m := f.Type.(*ast.MapType)
+			info.varLen = true
+			g.need.bufio = true
+			for _, e := range []ast.Expr{m.Key, m.Value} {
+				einfo := g.analyze(&ast.Field{Type: e})
+				info.hasString = info.hasString || einfo.hasString
+				info.mustDispatch = info.mustDispatch || einfo.mustDispatch
+			}
 		default:
-			fmt.Println("Unknown type in struct: ", f)
-			panic("Unknown type in struct")
+			fail(f.Type, "can't encode %s", types.ExprString(f.Type))
 		}
 	default:
 		panic("Unknown ast type")
@@ -501,51 +1559,235 @@ func analyze(n interface{}) (info *StructInfo) {
 	return
 }
 
-func analyzeType(typeName string) (info *StructInfo) {
-	ts, ok := globalDeclMap[typeName]
-	if !ok {
-		return nil
+// sizeBounds returns the smallest and largest encoding of a value of
+// type t, in a field tagged tag.  max is -1 if it is unbounded or depends
+// on a type declared elsewhere, and ok is false if min does.
+func (g *generator) sizeBounds(t ast.Expr, tag fieldTag, visiting map[string]bool) (min, max int, ok bool) {
+	switch t := t.(type) {
+	case *ast.Ident, *ast.SelectorExpr:
+		if ti, ok := g.basic(t); ok {
+			if ti.EncodesAs == "string" {
+				min, max = tag.lenBounds(1)
+				return min, max, true
+			}
+			if tag.varint || tag.uvarint {
+				return 1, (8*ti.Size + 6) / 7, true
+			}
+			return ti.Size, ti.Size, true
+		}
+		if ts := g.inlined(t); ts != nil {
+			if visiting[ts.Name.Name] {
+				return 0, -1, true
+			}
+			visiting[ts.Name.Name] = true
+			defer delete(visiting, ts.Name.Name)
+			return g.sizeBounds(ts.Type, tag, visiting)
+		}
+		ts := g.decl(t)
+		if ts == nil {
+			return 0, -1, false
+		}
+		st := g.structOf(ts.Type)
+		if st == nil {
+			return 0, -1, false
+		}
+		tname := ts.Name.Name
+		if visiting[tname] {
+			// Only reachable through a pointer, slice or map, which
+			// don't use min.
+			return 0, -1, true
+		}
+		visiting[tname] = true
+		defer delete(visiting, tname)
+		ok = true
+		for _, f := range st.Fields.List {
+			ftag := parseTag(f)
+			if ftag.skip {
+				continue
+			}
+			fmin, fmax, fok := g.sizeBounds(f.Type, ftag, visiting)
+			for range f.Names {
+				min += fmin
+				if max >= 0 && fmax >= 0 {
+					max += fmax
+				} else {
+					max = -1
+				}
+			}
+			ok = ok && fok
+		}
+		return min, max, ok
+	case *ast.ArrayType:
+		if t.Len == nil {
+			_, emax, _ := g.sizeBounds(t.Elt, tag.elements(), visiting)
+			min, max = tag.lenBounds(emax)
+			return min, max, true
+		}
+		n := g.arrayLength(t)
+		emin, emax, eok := g.sizeBounds(t.Elt, tag, visiting)
+		if emax >= 0 {
+			emax *= n
+		}
+		return emin * n, emax, eok
+	case *ast.StarExpr:
+		_, pmax, _ := g.sizeBounds(t.X, tag, visiting)
+		if pmax >= 0 {
+			pmax++
+		}
+		return 1, pmax, true
+	case *ast.MapType:
+		_, kmax, _ := g.sizeBounds(t.Key, tag.elements(), visiting)
+		_, vmax, _ := g.sizeBounds(t.Value, tag.elements(), visiting)
+		emax := -1
+		if kmax >= 0 && vmax >= 0 {
+			emax = kmax + vmax
+		}
+		min, max = tag.lenBounds(emax)
+		return min, max, true
+	}
+	return 0, -1, false
+}
+
+// elements is the tag that applies to the elements of a slice or map.
+func (tag fieldTag) elements() fieldTag {
+	tag.lenType, tag.max = "", 0
+	return tag
+}
+
+// lenBounds returns the bounds of a length prefix followed by up to
+// tag.max elements of at most emax bytes each.
+func (tag fieldTag) lenBounds(emax int) (min, max int) {
+	min = 1
+	if tag.lenType != "" {
+		min = typedb[lenTypes[tag.lenType]].Size
+	}
+	if tag.max == 0 || emax < 0 {
+		return min, -1
+	}
+	prefix := min
+	if tag.lenType == "" {
+		prefix = len(binary.AppendVarint(nil, int64(tag.max)))
 	}
+	return min, prefix + tag.max*emax
+}
+
+// analyzeType analyzes ts, which is one of our struct types.
+func (g *generator) analyzeType(ts *ast.TypeSpec) (info *StructInfo) {
+	typeName := ts.Name.Name
+	defer inType(typeName)
+	g.analyzing[typeName] = true
+	defer delete(g.analyzing, typeName)
+	mark := len(g.failures)
+	info = g.analyze(g.structOf(ts.Type))
+	blame(g.failures[mark:], typeName)
+	return info
+}
 
-	if st, ok := ts.Type.(*ast.StructType); ok {
-		info = analyze(st)
-		return info
+// analyzeNamed analyzes ts, which is not a struct type.  Named basic,
+// array, slice and map types get methods too, unless they have their
+// own; other types are skipped, and so are those that can't be encoded,
+// unless they were asked for by name.
+func (g *generator) analyzeNamed(ts *ast.TypeSpec) (info *StructInfo) {
+	t := g.info.TypeOf(ts.Name)
+	if t == nil {
+		g.skip(ts, "its type can't be resolved")
+		return nil
+	}
+	switch t.Underlying().(type) {
+	case *types.Basic, *types.Array, *types.Slice, *types.Map:
+	default:
+		g.skip(ts, "only struct, array, slice, map and basic types get methods")
+		return nil
 	}
+	if g.ownMethods(ts) {
+		g.skip(ts, "it has its own methods")
+		return nil
+	}
+	if !g.requested(ts.Name.Name) {
+		defer func() {
+			if r := recover(); r != nil {
+				f, ok := r.(*failure)
+				if !ok {
+					panic(r)
+				}
+				g.skip(ts, f.msg)
+				info = nil
+			}
+		}()
+	}
+	info = &StructInfo{contiguous: make([]int, 1)}
+	mergeInfo(info, g.analyze(&ast.Field{Type: ts.Name}), 1)
+	return info
+}
 
-	if id, ok := ts.Type.(*ast.Ident); ok {
-		tname := id.Name
-		if ti, ok := typedb[tname]; ok {
-			typemap[typeName] = tname
-			info = &StructInfo{size: ti.Size, maxSize: ti.Size, maxContiguous: ti.Size, totalSize: ti.Size}
-			return info
+// requested reports whether the type name was asked for with SetTypes.
+func (g *generator) requested(name string) bool {
+	for _, t := range g.types {
+		if t == name {
+			return true
 		}
 	}
-	panic("Can't handle decl: " + typeName)
-	return
+	return false
 }
 
-func (bi *Binidl) structmap(out io.Writer, ts *ast.TypeSpec) {
+func (g *generator) structmap(out io.Writer, ts *ast.TypeSpec) {
 	typeName := ts.Name.Name
-	st, ok := ts.Type.(*ast.StructType)
-	if !ok {
-		//fmt.Println("Type of type is ", reflect.TypeOf(ts.Type))
-		if id, ok := ts.Type.(*ast.Ident); ok {
-			tname := id.Name
-			if _, ok := typedb[tname]; ok {
-				typemap[typeName] = tname
-				return
-			}
+	if ts.Assign.IsValid() {
+		g.skip(ts, "it is an alias, encoded as "+types.ExprString(ts.Type)+" where it is used")
+		return
+	}
+	if ts.TypeParams != nil {
+		g.skip(ts, "generic types are not supported")
+		return
+	}
+	st := g.structOf(ts.Type)
+	var info *StructInfo
+	if st != nil {
+		info = g.analyze(st)
+		//fmt.Println("Analysis result: ", info)
+		if len(g.failures) > 0 {
+			return
+		}
+	} else if info = g.analyzeNamed(ts); info == nil {
+		return
+	}
+
+	// Other types are encoded as a struct with a single field.
+	walk := func(b io.Writer, funcname string, fn func(io.Writer, string, ast.Expr, *EmitState), es *EmitState) {
+		if st != nil {
+			walkContents(b, st, "t", funcname, fn, es)
+			return
+		}
+		es.field = "*t"
+		walkOne(b, &ast.Field{Type: ts.Name}, "(*t)", funcname, fn, es)
+	}
+
+	fixed := !info.varLen && !info.mustDispatch
+	min, max, ok := g.sizeBounds(ts.Name, fieldTag{}, make(map[string]bool))
+	if ok {
+		fmt.Fprintf(out, "const (\n")
+		if fixed {
+			fmt.Fprintf(out, "%sBinarySize = %d\n", typeName, info.size)
 		}
-		panic("Can't handle decl!")
+		fmt.Fprintf(out, "%sMinBinarySize = %d\n", typeName, min)
+		if max >= 0 {
+			fmt.Fprintf(out, "%sMaxBinarySize = %d\n", typeName, max)
+		}
+		fmt.Fprintf(out, ")\n\n")
 	}
-	info := analyze(st)
-	//fmt.Println("Analysis result: ", info)
 
+	// BinarySize is only unknown if a type it dispatches to says so.
+	ses := &EmitState{g: g, op: SIZE}
+	sbody := new(bytes.Buffer)
+	walk(sbody, "BinarySize", sizeField, ses)
 	fmt.Fprintf(out, "func (t *%s) BinarySize() (nbytes int, sizeKnown bool) {\n", typeName)
-	if !info.varLen && !info.mustDispatch {
-		fmt.Fprintf(out, "  return %d, true\n", info.size)
+	if fixed {
+		fmt.Fprintf(out, "return %sBinarySize, true\n", typeName)
+	} else if sbody.Len() == 0 {
+		fmt.Fprintf(out, "return %d, true\n", ses.size)
 	} else {
-		fmt.Fprintf(out, "return 0, false\n")
+		sbody.WriteTo(out)
+		fmt.Fprintf(out, "return nbytes + %d, true\n", ses.size)
 	}
 	fmt.Fprintln(out, "}")
 
@@ -553,7 +1795,7 @@ func (bi *Binidl) structmap(out io.Writer, ts *ast.TypeSpec) {
 	fmt.Fprintf(out, "  mu sync.Mutex\n")
 	fmt.Fprintf(out, "  cache []*%s\n", typeName)
 	fmt.Fprintf(out, "}\n\n")
-    fmt.Fprintf(out, "func New%sCache() *%sCache {\nc := &%sCache{}\nc.cache = make([]*%s, 0)\nreturn c\n}\n\n", typeName, typeName, typeName, typeName)
+	fmt.Fprintf(out, "func New%sCache() *%sCache {\nc := &%sCache{}\nc.cache = make([]*%s, 0)\nreturn c\n}\n\n", typeName, typeName, typeName, typeName)
 
 	fmt.Fprintf(out, "func (p *%sCache) Get() *%s {\n", typeName, typeName)
 	fmt.Fprintf(out, "var t *%s\n", typeName)
@@ -563,7 +1805,7 @@ func (bi *Binidl) structmap(out io.Writer, ts *ast.TypeSpec) {
 	fmt.Fprintf(out, "  p.cache = p.cache[0:(len(p.cache)-1)]\n")
 	fmt.Fprintf(out, "}\n")
 	fmt.Fprintf(out, "p.mu.Unlock()\n")
-	fmt.Fprintf(out, "if t == nil { t = &%s{} }\n", typeName)
+	fmt.Fprintf(out, "if t == nil { t = new(%s) }\n", typeName)
 	fmt.Fprintf(out, "return t")
 	fmt.Fprintf(out, "}\n")
 
@@ -579,19 +1821,32 @@ func (bi *Binidl) structmap(out io.Writer, ts *ast.TypeSpec) {
 	if info.varLen && blen < 10 {
 		blen = 10
 	}
+	if info.hasString && blen < STATICMAX {
+		blen = STATICMAX
+	}
 
-   	mes := &EmitState{bigEndian: bi.bigEndian, op: MARSHAL, contiguous: info.contiguous, blen: blen}
+	mes := &EmitState{g: g, bigEndian: g.bigEndian, strict: g.strict, sortKeys: g.sortKeys, op: MARSHAL, contiguous: info.contiguous, blen: blen}
 
-	fmt.Fprintf(out, "func (t *%s) Marshal(wire io.Writer) {\n", typeName)
-	if (blen > 0) {
-		fmt.Fprintf(out, "var b [%d]byte\n", blen)
+	mbody := new(bytes.Buffer)
+	walk(mbody, "Marshal", marshalField, mes)
+	fmt.Fprintf(out, "func (t *%s) Marshal(wire io.Writer) error {\n", typeName)
+	declareScratch(out, blen, mes)
+	mbody.WriteTo(out)
+	fmt.Fprintf(out, "return nil\n}\n\n")
+
+	// AppendBinary shares Marshal's layout, but bs points into dst
+	// instead of a local buffer, so only declare it if it is used.
+	aes := &EmitState{g: g, bigEndian: g.bigEndian, sortKeys: g.sortKeys, op: APPEND, contiguous: info.contiguous}
+	abody := new(bytes.Buffer)
+	walk(abody, "AppendBinary", marshalField, aes)
+	fmt.Fprintf(out, "func (t *%s) AppendBinary(dst []byte) ([]byte, error) {\n", typeName)
+	if aes.usedBs {
 		fmt.Fprintf(out, "var bs []byte\n")
-		mes.curBSize = 0
 	}
-	walkContents(out, st, "t", "Marshal", marshalField, mes)
-	fmt.Fprintf(out, "}\n\n")
+	abody.WriteTo(out)
+	fmt.Fprintf(out, "return dst, nil\n}\n\n")
 
-	ues := &EmitState{bigEndian: bi.bigEndian, op: UNMARSHAL, contiguous: info.contiguous, blen: blen}
+	ues := &EmitState{g: g, bigEndian: g.bigEndian, strict: g.strict, op: UNMARSHAL, contiguous: info.contiguous, blen: blen}
 	paramname := "wire"
 	if info.varLen {
 		paramname = "rr"
@@ -605,76 +1860,341 @@ func (bi *Binidl) structmap(out io.Writer, ts *ast.TypeSpec) {
 				wire = bufio.NewReader(rr)
 			}`)
 	}
-	if blen > 0 {
+	ubody := new(bytes.Buffer)
+	walk(ubody, "Unmarshal", unmarshalField, ues)
+	declareScratch(out, blen, ues)
+	ubody.WriteTo(out)
+	fmt.Fprintf(out, "return nil\n}\n\n")
+
+	// UnmarshalFromBytes decodes in place, so like AppendBinary it
+	// needs no local buffer.
+	des := &EmitState{g: g, bigEndian: g.bigEndian, strict: g.strict, zeroCopy: g.zeroCopy, op: DECODE, contiguous: info.contiguous}
+	dbody := new(bytes.Buffer)
+	walk(dbody, "UnmarshalFromBytes", unmarshalField, des)
+	if len(des.aliased) > 0 {
+		fmt.Fprintf(out, "// UnmarshalFromBytes leaves %s pointing into data;\n", strings.Join(des.aliased, ", "))
+		fmt.Fprintf(out, "// they are only valid for as long as data is not modified.\n")
+	}
+	fmt.Fprintf(out, "func (t *%s) UnmarshalFromBytes(data []byte) (n int, err error) {\n", typeName)
+	if des.usedBs {
+		fmt.Fprintf(out, "var bs []byte\n")
+	}
+	dbody.WriteTo(out)
+	fmt.Fprintf(out, "return n, nil\n}\n\n")
+
+	g.binaryMarshaler(out, typeName, info, len(des.aliased) > 0)
+}
+
+// declareScratch declares the buffers used by Marshal or Unmarshal.
+func declareScratch(out io.Writer, blen int, es *EmitState) {
+	if es.usedB {
 		fmt.Fprintf(out, "var b [%d]byte\n", blen)
+	}
+	if es.usedBs {
 		fmt.Fprintf(out, "var bs []byte\n")
 	}
-	walkContents(out, st, "t", "Unmarshal", unmarshalField, ues)
-	fmt.Fprintf(out, "return nil\n}\n\n")
 }
 
-var globalDeclMap map[string]*ast.TypeSpec = make(map[string]*ast.TypeSpec)
+// binaryMarshaler emits the encoding.BinaryMarshaler and
+// encoding.BinaryUnmarshaler methods on top of AppendBinary and
+// UnmarshalFromBytes.
+func (g *generator) binaryMarshaler(out io.Writer, typeName string, info *StructInfo, aliases bool) {
+	fmt.Fprintf(out, "func (t *%s) MarshalBinary() ([]byte, error) {\n", typeName)
+	if !info.varLen && !info.mustDispatch {
+		fmt.Fprintf(out, "return t.AppendBinary(make([]byte, 0, %sBinarySize))\n", typeName)
+	} else {
+		fmt.Fprintf(out, "nbytes, _ := t.BinarySize()\n")
+		fmt.Fprintf(out, "return t.AppendBinary(make([]byte, 0, nbytes))\n")
+	}
+	fmt.Fprintf(out, "}\n\n")
 
-func createGlobalDeclMap(decls []ast.Decl) {
-	for _, d := range decls {
-		if decl, ok := d.(*ast.GenDecl); ok && decl.Tok == token.TYPE {
-			ts := decl.Specs[0].(*ast.TypeSpec)
-			globalDeclMap[ts.Name.Name] = ts
+	fmt.Fprintf(out, "func (t *%s) UnmarshalBinary(data []byte) error {\n", typeName)
+	if aliases {
+		// UnmarshalBinary may not retain data, so go the copying route.
+		g.need.bytes = true
+		fmt.Fprintf(out, "r := bytes.NewReader(data)\n")
+		fmt.Fprintf(out, "if err := t.Unmarshal(r); err != nil {\n")
+		fmt.Fprintf(out, "return err\n")
+		fmt.Fprintf(out, "}\n")
+		if g.strict {
+			g.need.errors = true
+			fmt.Fprintf(out, "if r.Len() != 0 {\n")
+			fmt.Fprintf(out, "return errors.New(\"%s: trailing data\")\n", typeName)
+			fmt.Fprintf(out, "}\n")
 		}
+		fmt.Fprintf(out, "return nil\n")
+	} else if g.strict {
+		g.need.errors = true
+		fmt.Fprintf(out, "n, err := t.UnmarshalFromBytes(data)\n")
+		fmt.Fprintf(out, "if err != nil {\n")
+		fmt.Fprintf(out, "return err\n")
+		fmt.Fprintf(out, "}\n")
+		fmt.Fprintf(out, "if n != len(data) {\n")
+		fmt.Fprintf(out, "return errors.New(\"%s: trailing data\")\n", typeName)
+		fmt.Fprintf(out, "}\n")
+		fmt.Fprintf(out, "return nil\n")
+	} else {
+		fmt.Fprintf(out, "_, err := t.UnmarshalFromBytes(data)\n")
+		fmt.Fprintf(out, "return err\n")
 	}
+	fmt.Fprintf(out, "}\n\n")
 }
 
-func (bf *Binidl) PrintGo() {
-	createGlobalDeclMap(bf.ast.Decls) // still a temporary hack
-	rest := new(bytes.Buffer)
-	simpleStructMap = make(map[string]*StructInfo)
-	for _, d := range globalDeclMap {
-		bf.structmap(rest, d)
+// skip notes that no methods are generated for ts, and why.
+func (g *generator) skip(ts *ast.TypeSpec, why string) {
+	g.skipped.add(&Error{Pos: g.fset.Position(ts.Pos()), Type: ts.Name.Name, Msg: why})
+}
+
+// imports records which packages the generated code uses.
+type imports struct {
+	bufio, binary, errors, math, sort, unsafe, bytes, bits bool
+	pkgs                                                   map[string]string // Those of the input's types, by name
+}
+
+// A generator holds the state of one run of GenerateSource.  Nothing outlives
+// the run, so a Binidl can be used again, or by several goroutines at once.
+type generator struct {
+	*Binidl
+	declMap         map[string]*ast.TypeSpec // Every type in the input
+	info            *types.Info
+	typeErrors      []types.Error
+	specs           map[*types.TypeName]*ast.TypeSpec // Our named types' declarations
+	simpleStructMap map[string]*StructInfo            // Fixed-size structs, which are encoded inline
+	need            imports
+	failures        []*failure      // Recorded while analyzing the current type
+	analyzing       map[string]bool // Types being analyzed, which can only be reached again by dispatch
+	skipped         ErrorList       // Types left out, and why
+}
+
+func (bi *Binidl) newGenerator() *generator {
+	g := &generator{
+		Binidl:          bi,
+		declMap:         make(map[string]*ast.TypeSpec),
+		specs:           make(map[*types.TypeName]*ast.TypeSpec),
+		simpleStructMap: make(map[string]*StructInfo),
+		need:            imports{pkgs: make(map[string]string)},
+		analyzing:       make(map[string]bool),
 	}
+	for _, f := range bi.files {
+		for _, d := range f.Decls {
+			if decl, ok := d.(*ast.GenDecl); ok && decl.Tok == token.TYPE {
+				for _, spec := range decl.Specs {
+					ts := spec.(*ast.TypeSpec)
+					g.declMap[ts.Name.Name] = ts
+				}
+			}
+		}
+	}
+	g.check()
+	return g
+}
 
-	tf, err := ioutil.TempFile("", "gobin-codegen")
-	if err != nil {
-		panic(err)
+// skipDirective reports whether doc contains a //binidl:skip line.
+func skipDirective(doc *ast.CommentGroup) bool {
+	if doc == nil {
+		return false
+	}
+	for _, c := range doc.List {
+		if c.Text == "//binidl:skip" || strings.HasPrefix(c.Text, "//binidl:skip ") {
+			return true
+		}
+	}
+	return false
+}
+
+// skipped reports whether f is tagged `bin:"-"`.  Unlike parseTag it
+// doesn't fail on a bad tag, which is left for the field's type to report.
+func skipped(f *ast.Field) bool {
+	if f.Tag == nil {
+		return false
+	}
+	tags, err := strconv.Unquote(f.Tag.Value)
+	return err == nil && reflect.StructTag(tags).Get("bin") == "-"
+}
+
+// typeRefs calls fn with the name of each type that t is built from.
+func typeRefs(t ast.Expr, fn func(string)) {
+	switch t := t.(type) {
+	case *ast.Ident:
+		fn(t.Name)
+	case *ast.StructType:
+		for _, f := range t.Fields.List {
+			if !skipped(f) {
+				typeRefs(f.Type, fn)
+			}
+		}
+	case *ast.ArrayType:
+		typeRefs(t.Elt, fn)
+	case *ast.StarExpr:
+		typeRefs(t.X, fn)
+	case *ast.MapType:
+		typeRefs(t.Key, fn)
+		typeRefs(t.Value, fn)
 	}
-	tfname := tf.Name()
-	defer os.Remove(tfname)
-	defer tf.Close()
+}
 
-    defer func() {
-        if r := recover(); r != nil {
-            fmt.Println("Panic when parsing generated output: ", r)
-            fmt.Println("Generated output in temporary file ", tfname)
-            os.Exit(-1)
-        }
-    }()
+// selectTypes returns the types to generate code for: the ones asked
+// for, and every type they refer to, since their methods call its methods.
+// They are in source order, so that the output doesn't change from run
+// to run.
+func (g *generator) selectTypes(errs *ErrorList) []*ast.TypeSpec {
+	var work []string
+	if g.types != nil {
+		for _, name := range g.types {
+			if _, ok := g.declMap[name]; !ok {
+				errs.add(&Error{Type: name, Msg: "no such type"})
+				continue
+			}
+			work = append(work, name)
+		}
+	} else {
+		for _, f := range g.files {
+			for _, d := range f.Decls {
+				decl, ok := d.(*ast.GenDecl)
+				if !ok || decl.Tok != token.TYPE || skipDirective(decl.Doc) {
+					continue
+				}
+				for _, spec := range decl.Specs {
+					if ts := spec.(*ast.TypeSpec); !skipDirective(ts.Doc) {
+						work = append(work, ts.Name.Name)
+					}
+				}
+			}
+		}
+	}
 
-	fmt.Fprintln(tf, "package", bf.ast.Name.Name)
+	selected := make(map[string]*ast.TypeSpec)
+	for len(work) > 0 {
+		name := work[len(work)-1]
+		work = work[:len(work)-1]
+		ts, ok := g.declMap[name]
+		if !ok || selected[name] != nil {
+			continue
+		}
+		selected[name] = ts
+		typeRefs(ts.Type, func(ref string) {
+			work = append(work, ref)
+		})
+	}
+	specs := make([]*ast.TypeSpec, 0, len(selected))
+	for _, ts := range selected {
+		specs = append(specs, ts)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Pos() < specs[j].Pos()
+	})
+	return specs
+}
+
+// generateType runs structmap, turning its failures into Errors.
+func (g *generator) generateType(out io.Writer, ts *ast.TypeSpec) (errs ErrorList) {
+	g.failures = nil
+	defer func() {
+		if r := recover(); r != nil {
+			f, ok := r.(*failure)
+			if !ok {
+				panic(r)
+			}
+			g.failures = append(g.failures, f)
+		}
+		blame(g.failures, ts.Name.Name)
+		for _, f := range g.failures {
+			errs = append(errs, &Error{Pos: g.fset.Position(f.pos), Type: f.typ, Field: f.field, Msg: f.msg})
+		}
+	}()
+	g.structmap(out, ts)
+	return nil
+}
+
+// GenerateSource returns the generated code, formatted like gofmt does.
+// If any type can't be generated, it returns an ErrorList saying why.
+// If the generated code doesn't parse, which is a bug in the generator,
+// it returns the unformatted code along with the error.
+func (bf *Binidl) GenerateSource() ([]byte, error) {
+	g := bf.newGenerator()
+	rest := new(bytes.Buffer)
+	var errs ErrorList
+	for _, d := range g.selectTypes(&errs) {
+		for _, err := range g.generateType(rest, d) {
+			errs.add(err)
+		}
+	}
+	g.skipped.sort()
+	if bf.skipFunc != nil {
+		for _, e := range g.skipped {
+			bf.skipFunc(e)
+		}
+	}
+	if len(errs) > 0 {
+		errs.sort()
+		return nil, errs
+	}
+
+	src := new(bytes.Buffer)
+	// This marks the file as generated for go vet, linters and code review.
+	fmt.Fprintf(src, "// Code generated by bi; DO NOT EDIT.\n\n")
+	fmt.Fprintln(src, "package", bf.files[0].Name.Name)
 	imports := []string{"io", "sync"}
-	if need_bufio {
+	if g.need.bytes {
+		imports = append(imports, "bytes")
+	}
+	if g.need.bufio {
 		imports = append(imports, "bufio")
 	}
-	if need_binary {
+	if g.need.binary {
 		imports = append(imports, "encoding/binary")
 	}
-	fmt.Fprintln(tf, "import (")
+	if g.need.errors {
+		imports = append(imports, "errors")
+	}
+	if g.need.math {
+		imports = append(imports, "math")
+	}
+	if g.need.bits {
+		imports = append(imports, "math/bits")
+	}
+	if g.need.sort {
+		imports = append(imports, "sort")
+	}
+	if g.need.unsafe {
+		imports = append(imports, "unsafe")
+	}
+	fmt.Fprintln(src, "import (")
 	for _, imp := range imports {
-		fmt.Fprintf(tf, "\"%s\"\n", imp)
+		fmt.Fprintf(src, "\"%s\"\n", imp)
 	}
-	fmt.Fprintln(tf, ")")
-	if need_bufio {
-		fmt.Fprintln(tf, `type byteReader interface {
+	for name, path := range g.need.pkgs {
+		fmt.Fprintln(src, importSpec(name, path))
+	}
+	fmt.Fprintln(src, ")")
+	if g.need.bufio {
+		fmt.Fprintln(src, `type byteReader interface {
 io.Reader
 ReadByte() (c byte, err error)
 }`)
 	}
-	// Output and then gofmt it to make it pretty and shiny.  And readable.
-	rest.WriteTo(tf)
-	tf.Sync()
+	rest.WriteTo(src)
 
-	fset := token.NewFileSet()
-	ast, err := parser.ParseFile(fset, tfname, nil, 0)
+	// Then gofmt it to make it pretty and shiny.  And readable.
+	formatted, err := format.Source(src.Bytes())
 	if err != nil {
-		panic(err.Error())
+		return src.Bytes(), fmt.Errorf("generated code doesn't parse: %v", err)
 	}
-	printer.Fprint(os.Stdout, fset, ast)
+	return formatted, nil
+}
+
+// Generate writes the generated code to w.  If GenerateSource fails, it
+// writes nothing and returns the error.
+func (bf *Binidl) Generate(w io.Writer) error {
+	src, err := bf.GenerateSource()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// PrintGo writes the generated code to standard output.
+func (bf *Binidl) PrintGo() error {
+	return bf.Generate(os.Stdout)
 }
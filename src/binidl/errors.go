@@ -0,0 +1,144 @@
+package binidl
+
+import (
+	"fmt"
+	"go/ast"
+	"go/scanner"
+	"go/token"
+	"sort"
+)
+
+// An Error is a problem with the input, such as a field of a type that
+// can't be encoded.
+type Error struct {
+	Pos   token.Position
+	Type  string // The type at fault, if known
+	Field string // The field at fault, if known
+	Msg   string
+}
+
+func (e *Error) Error() string {
+	s := e.Msg
+	if e.Type != "" && e.Field != "" {
+		s = e.Type + "." + e.Field + ": " + s
+	} else if e.Type != "" {
+		s = e.Type + ": " + s
+	}
+	if e.Pos.IsValid() || e.Pos.Filename != "" {
+		s = e.Pos.String() + ": " + s
+	}
+	return s
+}
+
+// ErrorList is every Error found in the input, in source order.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+// Err returns l, or nil if it is empty.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+func (l ErrorList) sort() {
+	sort.SliceStable(l, func(i, j int) bool {
+		a, b := l[i].Pos, l[j].Pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Offset < b.Offset
+	})
+}
+
+// add appends e unless it is already in l.  A type used by several
+// others would otherwise be reported once for each of them.
+func (l *ErrorList) add(e *Error) {
+	for _, old := range *l {
+		if *old == *e {
+			return
+		}
+	}
+	*l = append(*l, e)
+}
+
+// parseErrors converts an error from go/parser.
+func parseErrors(err error) ErrorList {
+	var l ErrorList
+	if list, ok := err.(scanner.ErrorList); ok {
+		for _, e := range list {
+			l = append(l, &Error{Pos: e.Pos, Msg: e.Msg})
+		}
+		return l
+	}
+	return ErrorList{{Msg: err.Error()}}
+}
+
+// A failure is how the generator gives up on a type.  It panics with
+// one, to be recovered by generateType, which turns it into an Error.
+type failure struct {
+	pos   token.Pos
+	typ   string
+	field string
+	msg   string
+}
+
+func fail(n ast.Node, format string, args ...interface{}) {
+	panic(&failure{pos: n.Pos(), msg: fmt.Sprintf(format, args...)})
+}
+
+// inField is deferred while working on a field, to blame it for any
+// failure that hasn't already been put down to a more deeply nested one.
+func inField(name string) {
+	if r := recover(); r != nil {
+		if f, ok := r.(*failure); ok && f.field == "" && f.typ == "" {
+			f.field = name
+		}
+		panic(r)
+	}
+}
+
+// record is deferred while analyzing a field.  Rather than giving up on
+// the whole type, it notes the failure, so that the remaining fields are
+// still checked and everything wrong can be reported at once.
+func (g *generator) record(field string) {
+	if r := recover(); r != nil {
+		f, ok := r.(*failure)
+		if !ok {
+			panic(r)
+		}
+		if f.field == "" && f.typ == "" {
+			f.field = field
+		}
+		g.failures = append(g.failures, f)
+	}
+}
+
+// blame puts failures that don't yet name their type down to typeName.
+func blame(failures []*failure, typeName string) {
+	for _, f := range failures {
+		if f.typ == "" {
+			f.typ = typeName
+		}
+	}
+}
+
+// inType is deferred while working on a type, like inField.
+func inType(name string) {
+	if r := recover(); r != nil {
+		if f, ok := r.(*failure); ok && f.typ == "" {
+			f.typ = name
+		}
+		panic(r)
+	}
+}
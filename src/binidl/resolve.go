@@ -0,0 +1,192 @@
+package binidl
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// check type-checks the input, along with the rest of its package, so
+// that the generator can go by what its type expressions mean rather than
+// how they are spelled.  Errors are kept rather than reported: the package
+// may well not compile without the code we are about to generate, and
+// only the types we encode matter.
+func (g *generator) check() {
+	g.info = &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{
+		Importer: importer.ForCompiler(token.NewFileSet(), "source", nil),
+		Error: func(err error) {
+			if terr, ok := err.(types.Error); ok {
+				g.typeErrors = append(g.typeErrors, terr)
+			}
+		},
+	}
+	files := append(append([]*ast.File(nil), g.files...), g.pkgFiles...)
+	conf.Check(g.files[0].Name.Name, g.fset, files, g.info)
+	// Types declared elsewhere in the package are encoded the same way
+	// as if they were in the input, but don't get methods of their own.
+	for _, f := range files {
+		for _, d := range f.Decls {
+			if decl, ok := d.(*ast.GenDecl); ok && decl.Tok == token.TYPE {
+				for _, spec := range decl.Specs {
+					ts := spec.(*ast.TypeSpec)
+					if obj, ok := g.info.Defs[ts.Name].(*types.TypeName); ok {
+						g.specs[obj] = ts
+					}
+				}
+			}
+		}
+	}
+}
+
+// typeOf returns the type that t stands for, failing with the type
+// checker's complaint if it doesn't stand for one.
+func (g *generator) typeOf(t ast.Expr) types.Type {
+	if typ := g.info.TypeOf(t); typ != nil && typ != types.Typ[types.Invalid] {
+		return typ
+	}
+	for _, err := range g.typeErrors {
+		if err.Pos >= t.Pos() && err.Pos < t.End() {
+			fail(t, "%s", err.Msg)
+		}
+	}
+	fail(t, "can't resolve type %s", types.ExprString(t))
+	return nil
+}
+
+// basic returns how t is encoded if it is a basic type underneath, such
+// as a named integer type, an alias or an imported type like time.Duration.
+func (g *generator) basic(t ast.Expr) (TypeInfo, bool) {
+	b, ok := g.typeOf(t).Underlying().(*types.Basic)
+	if !ok {
+		return TypeInfo{}, false
+	}
+	ti, ok := typedb[b.Name()]
+	return ti, ok
+}
+
+// decl returns the declaration of the named type t, if it is one of ours.
+// Unlike typeOf, it doesn't fail if t can't be resolved.
+func (g *generator) decl(t ast.Expr) *ast.TypeSpec {
+	named, ok := types.Unalias(g.info.TypeOf(t)).(*types.Named)
+	if !ok {
+		return nil
+	}
+	return g.specs[named.Obj()]
+}
+
+// structOf returns the struct type t is, either directly or by way of
+// other named types that we declare, or nil if t is not a struct.
+func (g *generator) structOf(t ast.Expr) *ast.StructType {
+	if st, ok := t.(*ast.StructType); ok {
+		return st
+	}
+	if ts := g.decl(t); ts != nil {
+		return g.structOf(ts.Type)
+	}
+	return nil
+}
+
+// isByte reports whether the slice or array element type elt is byte,
+// so that it can be moved in bulk.  A named byte type can't: a slice of
+// it is not a []byte.
+func (g *generator) isByte(elt ast.Expr) bool {
+	return types.Identical(g.typeOf(elt), types.Typ[types.Byte])
+}
+
+// arrayLength returns the length of the array type s.
+func (g *generator) arrayLength(s *ast.ArrayType) int {
+	return int(g.typeOf(s).(*types.Array).Len())
+}
+
+// dispatchMethods are what the generated code calls on types it doesn't
+// generate itself.
+var dispatchMethods = []string{"Marshal", "Unmarshal", "AppendBinary", "UnmarshalFromBytes", "BinarySize"}
+
+// checkMethods fails unless t, which we don't generate code for, has the
+// methods that the generated code dispatches to.
+func (g *generator) checkMethods(t ast.Expr) {
+	mset := types.NewMethodSet(types.NewPointer(g.typeOf(t)))
+	for _, m := range dispatchMethods {
+		if mset.Lookup(nil, m) == nil {
+			fail(t, "can't encode %s, which is not a struct or basic type and has no %s method", types.ExprString(t), m)
+		}
+	}
+}
+
+// typeString returns t as it is written in the generated code, noting
+// any package it needs to import.
+func (g *generator) typeString(t ast.Expr) string {
+	ast.Inspect(t, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		id, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		if pkg, ok := g.info.Uses[id].(*types.PkgName); ok {
+			path := pkg.Imported().Path()
+			if other, ok := g.need.pkgs[id.Name]; ok && other != path {
+				fail(id, "package name %s refers to both %s and %s", id.Name, other, path)
+			}
+			g.need.pkgs[id.Name] = path
+		}
+		return false
+	})
+	return types.ExprString(t)
+}
+
+// importSpec returns how to import path as name.
+func importSpec(name, path string) string {
+	if name == path[strings.LastIndex(path, "/")+1:] {
+		return "\"" + path + "\""
+	}
+	return name + " \"" + path + "\""
+}
+
+// inlined returns the declaration of t if it is one of our aliases or
+// named array, slice or map types, which are encoded as the type they
+// are defined as.
+func (g *generator) inlined(t ast.Expr) *ast.TypeSpec {
+	if id, ok := t.(*ast.Ident); ok {
+		// Aliases of named types are handled by decl.
+		if obj, ok := g.info.Uses[id].(*types.TypeName); ok && obj.IsAlias() && g.specs[obj] != nil {
+			if _, named := types.Unalias(obj.Type()).(*types.Named); !named {
+				return g.specs[obj]
+			}
+		}
+	}
+	ts := g.decl(t)
+	if ts == nil || g.ownMethods(ts) {
+		return nil
+	}
+	switch g.info.TypeOf(ts.Name).Underlying().(type) {
+	case *types.Array, *types.Slice, *types.Map:
+		return ts
+	}
+	return nil
+}
+
+// ownMethods reports whether the type declared by ts already has some of
+// the methods we generate, so that it must encode itself.
+func (g *generator) ownMethods(ts *ast.TypeSpec) bool {
+	obj := g.info.Defs[ts.Name]
+	if obj == nil {
+		return false
+	}
+	mset := types.NewMethodSet(types.NewPointer(obj.Type()))
+	for _, m := range dispatchMethods {
+		if mset.Lookup(nil, m) != nil {
+			return true
+		}
+	}
+	return false
+}
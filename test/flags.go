@@ -0,0 +1,10 @@
+package encodedemo
+
+type Flag bool
+
+type Flagged struct {
+	A     bool
+	N     int16
+	F     Flag
+	Flags [3]bool
+}
@@ -0,0 +1,12 @@
+package encodedemo
+
+type Celsius float64
+
+type Measurement struct {
+	ID      int32
+	T       Celsius
+	H       float32
+	Z       complex64
+	W       complex128
+	Samples [3]float32
+}
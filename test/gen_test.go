@@ -4,8 +4,20 @@ import (
 	"testing"
 	"bytes"
 	"fmt"
+	"go/format"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"binidl"
+	"encoding"
 	"encoding/binary"
 	"encoding/gob"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
 )
 
 var d *Demostruct = &Demostruct{1, 2, [4]int16{9, 9, 9, 9}}
@@ -66,7 +78,812 @@ func TestEmbedded2(t *testing.T) {
 	if (x.A != y.A || x.B != y.B || x.C.X != y.C.X ||
 		x.C.Z.X != y.C.Z.X || x.C.Z.Y != y.C.Z.Y ||
 		x.C.Y != y.C.Y) {
-		t.Fatalf("Structures not the same: ", x, y)
+		t.Fatalf("Structures not the same: %v %v", x, y)
+	}
+}
+
+func TestStrings(t *testing.T) {
+	x := &Labeled{7, "duck", Label(strings.Repeat("quack", 20)), []string{"a", "", "bc"}, -3}
+	buf.Reset()
+	x.Marshal(buf)
+	y := &Labeled{}
+	if err := y.Unmarshal(buf); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Fatalf("Structures not the same: %v %v", x, y)
+	}
+}
+
+func TestBool(t *testing.T) {
+	x := &Flagged{true, 5, Flag(true), [3]bool{false, true, false}}
+	buf.Reset()
+	binary.Write(buf, binary.LittleEndian, x)
+	bin := append([]byte(nil), buf.Bytes()...)
+	buf.Reset()
+	x.Marshal(buf)
+	if !bytes.Equal(bin, buf.Bytes()) {
+		t.Fatalf("Generated % x, binary.Write % x", buf.Bytes(), bin)
+	}
+	y := &Flagged{}
+	if err := y.Unmarshal(buf); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if *x != *y {
+		t.Fatalf("Structures not the same: %v %v", x, y)
+	}
+	bin[0] = 2
+	if err := y.Unmarshal(bytes.NewReader(bin)); err == nil {
+		t.Fatalf("Strict unmarshal accepted a bool byte of 2")
+	}
+}
+
+func TestFloat(t *testing.T) {
+	x := &Measurement{-1, Celsius(21.5), float32(math.Inf(-1)), complex(1.5, -2), complex(math.Pi, math.E), [3]float32{0.25, -0.5, 1e-30}}
+	buf.Reset()
+	binary.Write(buf, binary.LittleEndian, x)
+	bin := append([]byte(nil), buf.Bytes()...)
+	buf.Reset()
+	x.Marshal(buf)
+	if !bytes.Equal(bin, buf.Bytes()) {
+		t.Fatalf("Generated % x, binary.Write % x", buf.Bytes(), bin)
+	}
+	y := &Measurement{}
+	if err := y.Unmarshal(buf); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if *x != *y {
+		t.Fatalf("Structures not the same: %v %v", x, y)
+	}
+}
+
+func TestMap(t *testing.T) {
+	x := &Mapped{ID: 3, Counts: map[string]int32{}, Points: map[uint16]Point{1: {2, 3}, 9: {-4, 5}},
+		Seen: map[bool][]byte{true: {1, 2}, false: nil}}
+	for i := 0; i < 50; i++ {
+		x.Counts[fmt.Sprint("k", i)] = int32(i)
+	}
+	buf.Reset()
+	x.Marshal(buf)
+	first := append([]byte(nil), buf.Bytes()...)
+	y := &Mapped{}
+	if err := y.Unmarshal(buf); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if y.ID != x.ID || !reflect.DeepEqual(x.Counts, y.Counts) || !reflect.DeepEqual(x.Points, y.Points) ||
+		len(y.Seen) != 2 || !bytes.Equal(y.Seen[true], x.Seen[true]) || len(y.Seen[false]) != 0 {
+		t.Fatalf("Structures not the same: %v %v", x, y)
+	}
+	for i := 0; i < 5; i++ {
+		buf.Reset()
+		y.Marshal(buf)
+		if !bytes.Equal(first, buf.Bytes()) {
+			t.Fatalf("Sorted map marshaled differently: % x vs % x", first, buf.Bytes())
+		}
+	}
+}
+
+func TestMapDuplicateKey(t *testing.T) {
+	x := &Mapped{Counts: map[string]int32{"a": 1}}
+	buf.Reset()
+	x.Marshal(buf)
+	enc := buf.Bytes()
+	// ID, then a count of 1 followed by the single "a" entry.
+	entry := enc[3 : 3+6]
+	dup := append([]byte(nil), enc[:2]...)
+	dup = append(dup, 4)
+	dup = append(dup, entry...)
+	dup = append(dup, entry...)
+	dup = append(dup, enc[3+6:]...)
+	y := &Mapped{}
+	if err := y.Unmarshal(bytes.NewReader(dup)); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Fatalf("Strict unmarshal accepted a duplicate map key: %v", err)
+	}
+}
+
+func TestPointer(t *testing.T) {
+	a := int32(-9)
+	x := &Optional{A: &a, P: &Point{1, 2}, L: &Labeled{ID: 4, Name: "n", Tags: []string{"t"}}, Q: 6}
+	buf.Reset()
+	x.Marshal(buf)
+	p := &Point{}
+	y := &Optional{P: p, N: &Point{7, 7}}
+	if err := y.Unmarshal(buf); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Fatalf("Structures not the same: %v %v", x, y)
+	}
+	if y.P != p {
+		t.Fatalf("Unmarshal did not reuse the existing pointee")
+	}
+}
+
+func TestNestedSlices(t *testing.T) {
+	x := &Nest{
+		Points: []Point{{1, 2}, {3, 4}, {-5, 6}},
+		Labels: []Labeled{{ID: 1, Name: "a", Tags: []string{}}, {ID: 2, L: "b", Tags: []string{"c", "d"}}},
+		Blobs:  [][]byte{{1, 2, 3}, {}, {4}},
+		Grid:   [][]int16{{1}, {2, 3}},
+		Pairs:  [2][]uint32{{7, 8, 9}, {10}},
+		Keys:   [][4]byte{{1, 2, 3, 4}, {5, 6, 7, 8}},
+		Q:      -11,
+	}
+	buf.Reset()
+	x.Marshal(buf)
+	y := &Nest{}
+	if err := y.Unmarshal(buf); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Fatalf("Structures not the same: %v %v", x, y)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes left over after Unmarshal", buf.Len())
+	}
+	buf.Reset()
+	x.Marshal(buf)
+	if err := y.Unmarshal(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Fatalf("Unmarshal of truncated input succeeded")
+	}
+}
+
+func TestByteArray(t *testing.T) {
+	x := &Hashed{ID: 0xdeadbeef, Tail: 0x1234, Pad: [3]uint8{7, 8, 9}}
+	for i := range x.Sum {
+		x.Sum[i] = byte(i * 3)
+	}
+	buf.Reset()
+	binary.Write(buf, binary.LittleEndian, x)
+	bin := append([]byte(nil), buf.Bytes()...)
+	buf.Reset()
+	x.Marshal(buf)
+	if !bytes.Equal(bin, buf.Bytes()) {
+		t.Fatalf("Generated % x, binary.Write % x", buf.Bytes(), bin)
+	}
+	y := &Hashed{}
+	if err := y.Unmarshal(buf); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if *x != *y {
+		t.Fatalf("Structures not the same: %v %v", x, y)
+	}
+}
+
+// failingWriter accepts n writes and then fails.
+type failingWriter struct {
+	n      int
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > w.n {
+		return 0, io.ErrShortWrite
+	}
+	return len(p), nil
+}
+
+func TestMarshalError(t *testing.T) {
+	x := &Nest{Points: []Point{{1, 2}}, Labels: []Labeled{{Name: "a"}}, Blobs: [][]byte{{1}}}
+	for n := 0; n < 6; n++ {
+		w := &failingWriter{n: n}
+		if err := x.Marshal(w); err != io.ErrShortWrite {
+			t.Fatalf("Marshal after %d writes returned %v", n, err)
+		}
+		if w.writes != n+1 {
+			t.Fatalf("Marshal kept writing after a failure: %d writes", w.writes)
+		}
+	}
+	if err := x.Marshal(&failingWriter{n: 1000}); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+}
+
+func TestBinaryMarshaler(t *testing.T) {
+	var _ encoding.BinaryMarshaler = &Hashed{}
+	var _ encoding.BinaryUnmarshaler = &Hashed{}
+
+	x := &Hashed{ID: 1, Tail: 2}
+	data, err := x.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+	if len(data) != 41 || cap(data) != 41 {
+		t.Fatalf("MarshalBinary returned len %d cap %d, want 41", len(data), cap(data))
+	}
+	y := &Hashed{}
+	if err := y.UnmarshalBinary(data); err != nil || *x != *y {
+		t.Fatalf("UnmarshalBinary failed: %v %v %v", err, x, y)
+	}
+
+	l := &Labeled{ID: 3, Name: "gob", Tags: []string{"a", "b"}}
+	gbuf := new(bytes.Buffer)
+	if err := gob.NewEncoder(gbuf).Encode(l); err != nil {
+		t.Fatalf("gob encode failed: %v", err)
+	}
+	l2 := &Labeled{}
+	if err := gob.NewDecoder(gbuf).Decode(l2); err != nil {
+		t.Fatalf("gob decode failed: %v", err)
+	}
+	if !reflect.DeepEqual(l, l2) {
+		t.Fatalf("Structures not the same: %v %v", l, l2)
+	}
+}
+
+type codec interface {
+	Marshal(io.Writer) error
+	Unmarshal(io.Reader) error
+	AppendBinary([]byte) ([]byte, error)
+	UnmarshalFromBytes([]byte) (int, error)
+	BinarySize() (int, bool)
+}
+
+func testValues() []codec {
+	a := int32(5)
+	return []codec{
+		&Hashed{ID: 1, Tail: 2, Sum: [32]byte{3}},
+		&Header{1, 2},
+		&Packet{Magic: 1, Body: []byte{2}, Seq: 1 << 40, Delta: []int32{-3, 1 << 20}, Tags: []string{"t"}, Flags: 4},
+		&Small{-300},
+		&Trailer{3},
+		&Flagged{true, 5, Flag(true), [3]bool{false, true, false}},
+		&Measurement{-1, 2.5, 3, complex(4, 5), complex(6, 7), [3]float32{8, 9, 10}},
+		&HasEmbedded2{1, 2, IsEmbedded2{3, AlsoEmbedded2{4, 5}, 6}},
+		&Mapped{ID: 3, Counts: map[string]int32{"a": 1, "b": 2, "c": 3}, Points: map[uint16]Point{1: {2, 3}}},
+		&Optional{A: &a, P: &Point{1, 2}, L: &Labeled{ID: 4, Name: "n"}},
+		&Nest{Points: []Point{{1, 2}}, Labels: []Labeled{{Name: "a"}}, Blobs: [][]byte{{1}}, Grid: [][]int16{{3}},
+			Pairs: [2][]uint32{{4}, {5}}, Keys: [][4]byte{{6}}, Q: 7},
+		&Resolved{N: 1, L: -2, Ls: []Level{3}, At: Spot{4, 5}, C: Corner{6, 7}, Wait: time.Second, Month: time.May,
+			Tags: map[Count]Level{8: 9}, Raw: []Octet{10}, Next: &Corner{11, 12}},
+		&Corner{1, 2},
+		&Digest{1, 2},
+		&IDs{3, 4},
+		&Index{"a": 5, "b": 6},
+		&Record{D: Digest{7}, Seen: IDs{8}, By: Index{"c": 9}, Raw: Blobs{10}, Prev: [2]Digest{{11}, {12}}, Q: 13},
+		&Node{1, &Node{2, &Node{3, nil}}},
+		&Tree{1, []Tree{{2, []Tree{}}, {3, []Tree{{4, []Tree{}}}}}},
+		&Forest{{}, {{}}},
+	}
+}
+
+func TestAppendBinary(t *testing.T) {
+	for _, x := range testValues() {
+		buf.Reset()
+		x.Marshal(buf)
+		prefix := []byte{0xaa}
+		data, err := x.AppendBinary(prefix)
+		if err != nil {
+			t.Fatalf("AppendBinary failed: %v", err)
+		}
+		if data[0] != 0xaa || !bytes.Equal(data[1:], buf.Bytes()) {
+			t.Fatalf("AppendBinary % x, Marshal % x", data, buf.Bytes())
+		}
+	}
+
+	h := &Hashed{ID: 1}
+	dst := make([]byte, 0, 64)
+	allocs := testing.AllocsPerRun(100, func() {
+		h.AppendBinary(dst)
+	})
+	if allocs != 0 {
+		t.Fatalf("AppendBinary into a preallocated buffer allocated %v times", allocs)
+	}
+}
+
+func TestBinarySize(t *testing.T) {
+	long := &Labeled{Name: strings.Repeat("x", 100), Tags: make([]string, 70)}
+	for _, x := range append(testValues(), long) {
+		data, _ := x.AppendBinary(nil)
+		n, ok := x.BinarySize()
+		if !ok || n != len(data) {
+			t.Fatalf("BinarySize of %v returned %d, %v; encoding is %d bytes", x, n, ok, len(data))
+		}
+	}
+}
+
+func TestSizeConstants(t *testing.T) {
+	if DemostructBinarySize != 20 || DemostructMinBinarySize != 20 || DemostructMaxBinarySize != 20 {
+		t.Fatalf("Demostruct sizes %d %d %d", DemostructBinarySize, DemostructMinBinarySize, DemostructMaxBinarySize)
+	}
+	if LabeledMinBinarySize != 9 || NestMinBinarySize != 11 || OptionalMinBinarySize != 5 {
+		t.Fatalf("Minimum sizes %d %d %d", LabeledMinBinarySize, NestMinBinarySize, OptionalMinBinarySize)
+	}
+	if SparseMinBinarySize != 3 || SparseMaxBinarySize != 15 {
+		t.Fatalf("Sparse sizes %d %d", SparseMinBinarySize, SparseMaxBinarySize)
+	}
+	a, b := int16(1), int16(2)
+	full, _ := (&Sparse{&Point{}, [2]*int16{&a, &b}}).BinarySize()
+	empty, _ := (&Sparse{}).BinarySize()
+	if full != SparseMaxBinarySize || empty != SparseMinBinarySize {
+		t.Fatalf("Sparse BinarySize %d..%d", empty, full)
+	}
+}
+
+// Route refers to Stop, which is declared in another file.
+func TestMultipleFiles(t *testing.T) {
+	if RouteBinarySize != 13 {
+		t.Fatalf("RouteBinarySize is %d, want 13", RouteBinarySize)
+	}
+	r := &Route{Stop{1, 2}, Stop{3, 4}, 5}
+	data, _ := r.MarshalBinary()
+	r2 := &Route{}
+	if err := r2.UnmarshalBinary(data); err != nil || *r2 != *r {
+		t.Fatalf("Unmarshaled %v, %v", r2, err)
+	}
+}
+
+// As run by go generate, bi is given one file but can see the rest of
+// its package, and only generates the types in that file.
+func TestPackageFiles(t *testing.T) {
+	out, err := exec.Command(buildBi(t), "multi_a.go").CombinedOutput()
+	if err != nil {
+		t.Fatalf("bi multi_a.go failed: %v\n%s", err, out)
+	}
+	if !bytes.Contains(out, []byte("func (t *Route) Marshal(")) || bytes.Contains(out, []byte("func (t *Stop)")) {
+		t.Fatalf("bi multi_a.go generated the wrong types:\n%s", out)
+	}
+	if bytes.Contains(out, []byte("t.From.Marshal(")) {
+		t.Fatalf("bi multi_a.go doesn't encode Stop inline:\n%s", out)
+	}
+}
+
+// Inner is generated because Envelope, which was asked for, uses it.
+func TestTypeSelection(t *testing.T) {
+	if EnvelopeBinarySize != 8 || InnerBinarySize != 4 || AckBinarySize != 4 {
+		t.Fatalf("Sizes %d %d %d", EnvelopeBinarySize, InnerBinarySize, AckBinarySize)
+	}
+}
+
+// Aliases and named types are encoded as what they stand for: Count as
+// a uint32, Level as an int16, Spot and Corner as a Coord.
+func TestResolvedTypes(t *testing.T) {
+	if CornerBinarySize != 8 || ResolvedMinBinarySize != 4+2+1+8+8+8+8+1+1+1 {
+		t.Fatalf("Sizes %d %d", CornerBinarySize, ResolvedMinBinarySize)
+	}
+	r := &Resolved{N: 1, L: -2, At: Spot{3, 4}, Wait: time.Minute, Ls: []Level{5}, Tags: map[Count]Level{6: 7}, Raw: []Octet{8}}
+	data, _ := r.MarshalBinary()
+	if !bytes.Equal(data[:17], []byte{1, 0, 0, 0, 0xfe, 0xff, 2, 5, 0, 3, 0, 0, 0, 4, 0, 0, 0}) {
+		t.Fatalf("Resolved marshaled as % x", data)
+	}
+	r2 := &Resolved{}
+	if err := r2.UnmarshalBinary(data); err != nil || !reflect.DeepEqual(r, r2) {
+		t.Fatalf("Unmarshaled %v, %v", r2, err)
+	}
+}
+
+// Named arrays, slices and basic types have methods of their own, and
+// encode the same way inline as a field.
+func TestNamedTypes(t *testing.T) {
+	if DigestBinarySize != 32 || FlagBinarySize != 1 || IDsMinBinarySize != 1 {
+		t.Fatalf("Sizes %d %d %d", DigestBinarySize, FlagBinarySize, IDsMinBinarySize)
+	}
+	d := Digest{1, 2, 3}
+	data, _ := d.MarshalBinary()
+	if !bytes.Equal(data, d[:]) {
+		t.Fatalf("Digest marshaled as % x", data)
+	}
+	f := Flag(true)
+	if data, _ := f.MarshalBinary(); !bytes.Equal(data, []byte{1}) {
+		t.Fatalf("Flag marshaled as % x", data)
+	}
+	ids := IDs{1, 2}
+	idsData, _ := ids.MarshalBinary()
+	r := &Record{D: d, Seen: ids}
+	data, _ = r.MarshalBinary()
+	if !bytes.Equal(data[:32], d[:]) || !bytes.Equal(data[32:32+len(idsData)], idsData) {
+		t.Fatalf("Record marshaled as % x", data)
+	}
+	var ids2 IDs
+	if err := ids2.UnmarshalBinary(idsData); err != nil || !reflect.DeepEqual(ids, ids2) {
+		t.Fatalf("Unmarshaled %v, %v", ids2, err)
+	}
+}
+
+func TestRecursiveTypes(t *testing.T) {
+	for _, x := range []codec{
+		&Node{1, &Node{2, &Node{3, nil}}},
+		&Tree{1, []Tree{{2, []Tree{}}, {3, []Tree{{4, []Tree{}}}}}},
+		&Forest{{}, {{}, {}}},
+	} {
+		data, err := x.AppendBinary(nil)
+		if err != nil {
+			t.Fatalf("AppendBinary of %v failed: %v", x, err)
+		}
+		y := reflect.New(reflect.TypeOf(x).Elem()).Interface().(codec)
+		if err := y.Unmarshal(bytes.NewReader(data)); err != nil || !reflect.DeepEqual(x, y) {
+			t.Fatalf("Unmarshal returned %v, %v for %v", y, err, x)
+		}
+		z := reflect.New(reflect.TypeOf(x).Elem()).Interface().(codec)
+		if n, err := z.UnmarshalFromBytes(data); err != nil || n != len(data) || !reflect.DeepEqual(x, z) {
+			t.Fatalf("UnmarshalFromBytes returned %v, %d, %v for %v", z, n, err, x)
+		}
+	}
+}
+
+func buildBi(t *testing.T) string {
+	bi := filepath.Join(t.TempDir(), "bi")
+	if out, err := exec.Command("go", "build", "-o", bi, "bi").CombinedOutput(); err != nil {
+		t.Fatalf("building bi: %v\n%s", err, out)
+	}
+	return bi
+}
+
+// Regenerating unchanged input must not change the output.
+func TestDeterministic(t *testing.T) {
+	bi := buildBi(t)
+	var first []byte
+	for i := 0; i < 5; i++ {
+		out, err := exec.Command(bi, "-strict", "-sortkeys", "-zerocopy", "slice.go", "grouped.go").Output()
+		if err != nil {
+			t.Fatalf("bi failed: %v", err)
+		}
+		if i == 0 {
+			first = out
+		} else if !bytes.Equal(out, first) {
+			t.Fatalf("run %d generated different output", i)
+		}
+	}
+}
+
+// bi reports every field it can't encode, compiler-style, and fails.
+func TestDiagnostics(t *testing.T) {
+	bi := buildBi(t)
+	bad := filepath.Join(t.TempDir(), "bad.go")
+	src := `package bad
+
+import "time"
+
+type A struct {
+	C chan int
+	P *Q
+	U Undefined
+	T time.Time
+}
+
+type Q struct {
+	X int32
+	F func()
+}
+`
+	if err := os.WriteFile(bad, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(bi, bad)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Fatalf("bi didn't fail: %v", err)
+	}
+	if len(out) != 0 {
+		t.Errorf("bi wrote output despite errors:\n%s", out)
+	}
+	want := bad + `:6:4: A.C: can't encode chan int
+` + bad + `:8:4: A.U: undefined: Undefined
+` + bad + `:9:4: A.T: can't encode time.Time, which is not a struct or basic type and has no Marshal method
+` + bad + `:14:4: Q.F: can't encode func()
+`
+	if stderr.String() != want {
+		t.Errorf("got errors:\n%s\nwant:\n%s", stderr.String(), want)
+	}
+}
+
+// Generating several files in one process, at the same time, gives the
+// same output as running bi on each of them.
+func TestConcurrentGeneration(t *testing.T) {
+	bi := buildBi(t)
+	inputs := []string{"slice.go", "hash.go", "flags.go", "grouped.go", "demostruct.go"}
+	want := make(map[string][]byte)
+	for _, in := range inputs {
+		out, err := exec.Command(bi, in).Output()
+		if err != nil {
+			t.Fatalf("bi %s: %v", in, err)
+		}
+		want[in] = out
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		for _, in := range inputs {
+			wg.Add(1)
+			go func(in string) {
+				defer wg.Done()
+				b, err := binidl.NewBinidl(in, false)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var out bytes.Buffer
+				if err := b.Generate(&out); err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(out.Bytes(), want[in]) {
+					t.Errorf("%s: output differs from running bi alone", in)
+				}
+			}(in)
+		}
+	}
+	wg.Wait()
+}
+
+// The library formats the output in memory and reports bad input as
+// errors rather than exiting.
+func TestGenerateSource(t *testing.T) {
+	b, err := binidl.NewBinidl("hash.go", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := b.GenerateSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatted, err := format.Source(src); err != nil || !bytes.Equal(formatted, src) {
+		t.Errorf("GenerateSource output isn't gofmt'd (%v)", err)
+	}
+
+	// Skipped types go to the skip func rather than to stderr, from both
+	// GenerateSource and Generate.
+	if b, err = binidl.NewBinidl("grouped.go", false); err != nil {
+		t.Fatal(err)
+	}
+	var skipped []*binidl.Error
+	b.SetSkipFunc(func(e *binidl.Error) { skipped = append(skipped, e) })
+	if _, err = b.GenerateSource(); err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0].Type != "Handler" || skipped[0].Pos.Line != 11 {
+		t.Errorf("GenerateSource skipped %v, want Handler on line 11", skipped)
+	}
+	skipped = nil
+	if err = b.Generate(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0].Type != "Handler" {
+		t.Errorf("Generate skipped %v, want Handler", skipped)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.go")
+	if err := os.WriteFile(bad, []byte("package bad\n\ntype A struct {\n\tC chan int\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = binidl.NewBinidl(bad, false); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = b.Generate(&out)
+	list, ok := err.(binidl.ErrorList)
+	if !ok || len(list) != 1 || list[0].Type != "A" || list[0].Field != "C" || list[0].Pos.Line != 4 {
+		t.Errorf("Generate returned %#v, want one error for A.C on line 4", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Generate wrote output despite errors")
+	}
+}
+
+// Run from go generate, bi writes foo_binidl.go next to $GOFILE.
+func TestGoGenerate(t *testing.T) {
+	bi := buildBi(t)
+	dir := t.TempDir()
+	src, err := os.ReadFile("hash.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "hash.go"), src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(bi)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFILE=hash.go")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("bi failed: %v\n%s", err, out)
+	}
+	gen, err := os.ReadFile(filepath.Join(dir, "hash_binidl.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(gen, []byte("// Code generated by bi; DO NOT EDIT.\n")) {
+		t.Fatalf("missing generated code header:\n%.80s", gen)
+	}
+
+	// Our own output is left out when reading the whole directory, and
+	// so are files that go build would leave out.
+	tool := "//go:build ignore\n\npackage main\n\nfunc main() {}\n"
+	if err := os.WriteFile(filepath.Join(dir, "tool.go"), []byte(tool), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(bi, "-o", "all.go", ".")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("bi failed: %v\n%s", err, out)
+	}
+	all, err := os.ReadFile(filepath.Join(dir, "all.go"))
+	if err != nil || !bytes.Equal(all, gen) {
+		t.Fatalf("bi -o all.go . wrote different output: %v", err)
+	}
+}
+
+func TestTags(t *testing.T) {
+	p := &Packet{0x01020304, 0x0506, []byte{7, 8}, 300, []int32{-1, 64}, []int{9}, []string{"a"}, 0x0a0b}
+	data, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+	want := []byte{1, 2, 3, 4, 5, 6, 2, 0, 7, 8, 0xac, 2, 4, 1, 0x80, 1, 1, 2, 'a', 0x0b, 0x0a}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("Packet encoded as % x, want % x", data, want)
+	}
+	p2 := &Packet{Scratch: []int{10}}
+	if err := p2.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	p.Scratch = []int{10}
+	if !reflect.DeepEqual(p, p2) {
+		t.Fatalf("Unmarshaled %v, want %v", p2, p)
+	}
+
+	p.Body = make([]byte, 1501)
+	if err := p.Marshal(io.Discard); err == nil {
+		t.Fatalf("Marshal of a 1501 byte Body succeeded")
+	}
+	if _, err := p.AppendBinary(nil); err == nil {
+		t.Fatalf("AppendBinary of a 1501 byte Body succeeded")
+	}
+	p.Body = nil
+	p.Tags = []string{"a", "b", "c", "d", "e"}
+	if err := p.Marshal(io.Discard); err == nil {
+		t.Fatalf("Marshal of 5 Tags succeeded")
+	}
+	long := append([]byte{1, 2, 3, 4, 5, 6, 0xdd, 0x05}, make([]byte, 1501)...)
+	if _, err := p2.UnmarshalFromBytes(long); err == nil || err == io.ErrUnexpectedEOF {
+		t.Fatalf("UnmarshalFromBytes of a 1501 byte Body returned %v", err)
+	}
+
+	s := &Small{}
+	if err := s.UnmarshalBinary(binary.AppendVarint(nil, 1<<20)); err == nil {
+		t.Fatalf("UnmarshalBinary of an out of range varint returned %v", s)
+	}
+
+	if FrameMinBinarySize != 3 || FrameMaxBinarySize != 19 || SmallMaxBinarySize != 3 {
+		t.Fatalf("Frame sizes %d %d, Small %d", FrameMinBinarySize, FrameMaxBinarySize, SmallMaxBinarySize)
+	}
+}
+
+func TestUnmarshalFromBytes(t *testing.T) {
+	for _, x := range testValues() {
+		data, _ := x.AppendBinary(nil)
+		data = append(data, 0xff)
+		y := reflect.New(reflect.TypeOf(x).Elem()).Interface().(codec)
+		n, err := y.UnmarshalFromBytes(data)
+		if err != nil || n != len(data)-1 {
+			t.Fatalf("UnmarshalFromBytes returned %d, %v for %d bytes", n, err, len(data)-1)
+		}
+		z := reflect.New(reflect.TypeOf(x).Elem()).Interface().(codec)
+		z.Unmarshal(bytes.NewReader(data))
+		if !reflect.DeepEqual(y, z) {
+			t.Fatalf("UnmarshalFromBytes %v, Unmarshal %v", y, z)
+		}
+		for short := 0; short < len(data)-1; short++ {
+			if _, err := y.UnmarshalFromBytes(data[:short]); err != io.ErrUnexpectedEOF {
+				t.Fatalf("UnmarshalFromBytes of %d/%d bytes returned %v", short, len(data)-1, err)
+			}
+		}
+	}
+
+	// A slice length that the input can't back is an error, not a
+	// huge allocation.
+	for _, c := range []struct {
+		x      codec
+		prefix []byte
+	}{
+		{&Sliced{}, make([]byte, 8)},
+		{&Nest{}, nil},
+		{&Blob{}, []byte{0}},
+		{&Labeled{}, make([]byte, 6)},
+		{&Forest{}, nil},
+	} {
+		data := binary.AppendVarint(c.prefix, 1<<50)
+		if _, err := c.x.UnmarshalFromBytes(data); err != io.ErrUnexpectedEOF {
+			t.Fatalf("UnmarshalFromBytes of a huge %T returned %v", c.x, err)
+		}
+	}
+}
+
+func TestHugeMapLength(t *testing.T) {
+	// A count that the input can't back must not size the map.
+	data := binary.AppendVarint([]byte{1, 0}, 1<<50)
+	m := &Mapped{}
+	if _, err := m.UnmarshalFromBytes(data); err != io.ErrUnexpectedEOF {
+		t.Fatalf("UnmarshalFromBytes returned %v", err)
+	}
+	if err := m.Unmarshal(bytes.NewReader(data)); err != io.ErrUnexpectedEOF && err != io.EOF {
+		t.Fatalf("Unmarshal returned %v", err)
+	}
+}
+
+func TestHugeStringLength(t *testing.T) {
+	// The length of a string is only trusted as far as the stream backs it.
+	for _, n := range []int64{1 << 40, 1 << 62} {
+		data := binary.AppendVarint(make([]byte, 4), n)
+		if err := new(Labeled).Unmarshal(bytes.NewReader(data)); err != io.ErrUnexpectedEOF {
+			t.Fatalf("Unmarshal of a %d byte string returned %v", n, err)
+		}
+	}
+	x := &Labeled{Name: strings.Repeat("long", 50000), Tags: []string{}}
+	data, _ := x.AppendBinary(nil)
+	y := &Labeled{}
+	if err := y.Unmarshal(bytes.NewReader(data)); err != nil || !reflect.DeepEqual(x, y) {
+		t.Fatalf("Unmarshal of a long string failed: %v", err)
+	}
+	if err := y.Unmarshal(bytes.NewReader(data[:100000])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Unmarshal of a truncated long string returned %v", err)
+	}
+}
+
+func TestHugeSliceLength(t *testing.T) {
+	// A stream that claims a huge slice must not make Unmarshal allocate it.
+	for _, c := range []struct {
+		x      codec
+		prefix []byte
+	}{
+		{&Sliced{}, make([]byte, 8)},
+		{&Nest{}, nil},
+		{&Blob{}, []byte{0}},
+	} {
+		for _, n := range []int64{1 << 40, 1 << 62} {
+			data := binary.AppendVarint(c.prefix, n)
+			if err := c.x.Unmarshal(bytes.NewReader(data)); err != io.ErrUnexpectedEOF && err != io.EOF {
+				t.Fatalf("Unmarshal of a %d element %T returned %v", n, c.x, err)
+			}
+		}
+	}
+	x := &Blob{Data: bytes.Repeat([]byte("long"), 50000)}
+	data, _ := x.AppendBinary(nil)
+	y := &Blob{}
+	if err := y.Unmarshal(bytes.NewReader(data)); err != nil || !reflect.DeepEqual(x, y) {
+		t.Fatalf("Unmarshal of a long []byte failed: %v", err)
+	}
+	if err := y.Unmarshal(bytes.NewReader(data[:100000])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Unmarshal of a truncated long []byte returned %v", err)
+	}
+}
+
+func TestZeroCopy(t *testing.T) {
+	x := &Blob{"key", []byte{1, 2, 3}, 4}
+	data, _ := x.MarshalBinary()
+	y := &Blob{}
+	if _, err := y.UnmarshalFromBytes(data); err != nil || !reflect.DeepEqual(x, y) {
+		t.Fatalf("UnmarshalFromBytes failed: %v %v %v", err, x, y)
+	}
+	z := &Blob{}
+	if err := z.UnmarshalBinary(data); err != nil || !reflect.DeepEqual(x, z) {
+		t.Fatalf("UnmarshalBinary failed: %v %v %v", err, x, z)
+	}
+	if cap(y.Data) != len(y.Data) {
+		t.Fatalf("Aliased slice has room to grow into the input: cap %d", cap(y.Data))
+	}
+	for i := range data {
+		data[i] = 'x'
+	}
+	if y.Key != "xxx" || !bytes.Equal(y.Data, []byte("xxx")) {
+		t.Fatalf("UnmarshalFromBytes copied its input: %v", y)
+	}
+	if !reflect.DeepEqual(x, z) {
+		t.Fatalf("UnmarshalBinary kept a reference to its input: %v", z)
+	}
+
+	// Map keys are copied, or changing the input would corrupt the map.
+	m := &Mapped{Counts: map[string]int32{"abc": 1}}
+	data, _ = m.AppendBinary(nil)
+	m2 := &Mapped{}
+	if _, err := m2.UnmarshalFromBytes(data); err != nil {
+		t.Fatalf("UnmarshalFromBytes failed: %v", err)
+	}
+	for i := range data {
+		data[i] = 'x'
+	}
+	if v, ok := m2.Counts["abc"]; !ok || v != 1 {
+		t.Fatalf("Map key changed with the input: %v", m2.Counts)
 	}
 }
 
@@ -0,0 +1,28 @@
+package encodedemo
+
+type (
+	Header struct {
+		Kind uint8
+		Len  uint16
+	}
+	Trailer struct {
+		Sum uint32
+	}
+	Handler func(*Header)
+	Kind    uint8
+)
+
+//binidl:skip
+type session struct {
+	done chan bool
+}
+
+type (
+	//binidl:skip
+	pending struct {
+		f func()
+	}
+	Ack struct {
+		Seq uint32
+	}
+)
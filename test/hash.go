@@ -0,0 +1,8 @@
+package encodedemo
+
+type Hashed struct {
+	ID   uint32
+	Sum  [32]byte
+	Tail uint16
+	Pad  [3]uint8
+}
@@ -0,0 +1,7 @@
+package encodedemo
+
+type Route struct {
+	From Stop
+	To   Stop
+	Hops uint8
+}
@@ -0,0 +1,6 @@
+package encodedemo
+
+type Stop struct {
+	ID   uint32
+	Zone uint16
+}
@@ -0,0 +1,20 @@
+package encodedemo
+
+// Named arrays, slices and maps get methods of their own, and are
+// encoded inline where they are used as fields.
+type Digest [32]byte
+
+type IDs []uint64
+
+type Index map[string]int32
+
+type Blobs = []byte
+
+type Record struct {
+	D    Digest
+	Seen IDs
+	By   Index
+	Raw  Blobs
+	Prev [2]Digest
+	Q    uint16
+}
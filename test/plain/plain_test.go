@@ -0,0 +1,92 @@
+package plain
+
+// The types of ../slice.go, generated without -strict, -sortkeys or
+// -zerocopy, so that the default code paths are tested as well.
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type codec interface {
+	Marshal(io.Writer) error
+	Unmarshal(io.Reader) error
+	AppendBinary([]byte) ([]byte, error)
+	UnmarshalFromBytes([]byte) (int, error)
+}
+
+// Slices and maps are never nil, as that is how they are unmarshaled.
+func testValues() []codec {
+	a := int32(5)
+	return []codec{
+		&Sliced{1, []int8{2, 3, 4}},
+		&Labeled{ID: 7, Name: "duck", L: "quack", Tags: []string{"a", "", "bc"}, Q: -3},
+		&Mapped{ID: 3, Counts: map[string]int32{"a": 1, "b": 2, "c": 3}, Points: map[uint16]Point{1: {2, 3}, 9: {-4, 5}},
+			Seen: map[bool][]byte{true: {1, 2}, false: {}}},
+		&Optional{A: &a, P: &Point{1, 2}, L: &Labeled{ID: 4, Name: "n", Tags: []string{}}, Q: 6},
+		&Nest{Points: []Point{{1, 2}}, Labels: []Labeled{{Name: "a", Tags: []string{"t"}}}, Blobs: [][]byte{{1}, {}},
+			Grid: [][]int16{{3}}, Pairs: [2][]uint32{{4}, {}}, Keys: [][4]byte{{6}}, Q: 7},
+		&Blob{"key", []byte{1, 2, 3}, 4},
+		&Sparse{P: &Point{1, 2}},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, x := range testValues() {
+		var buf bytes.Buffer
+		if err := x.Marshal(&buf); err != nil {
+			t.Fatalf("Marshal of %v failed: %v", x, err)
+		}
+		data, _ := x.AppendBinary(nil)
+		if !bytes.Equal(data, buf.Bytes()) {
+			t.Fatalf("AppendBinary % x, Marshal % x", data, buf.Bytes())
+		}
+		y := reflect.New(reflect.TypeOf(x).Elem()).Interface().(codec)
+		if err := y.Unmarshal(&buf); err != nil || !reflect.DeepEqual(x, y) {
+			t.Fatalf("Unmarshal returned %v, %v for %v", y, err, x)
+		}
+		z := reflect.New(reflect.TypeOf(x).Elem()).Interface().(codec)
+		if n, err := z.UnmarshalFromBytes(data); err != nil || n != len(data) || !reflect.DeepEqual(x, z) {
+			t.Fatalf("UnmarshalFromBytes returned %v, %d, %v for %v", z, n, err, x)
+		}
+		// Without -zerocopy, nothing points into the input.
+		for i := range data {
+			data[i] = 'x'
+		}
+		if !reflect.DeepEqual(x, z) {
+			t.Fatalf("UnmarshalFromBytes kept a reference to its input: %v", z)
+		}
+		data, _ = x.AppendBinary(nil)
+		for short := 0; short < len(data); short++ {
+			if _, err := z.UnmarshalFromBytes(data[:short]); err != io.ErrUnexpectedEOF {
+				t.Fatalf("UnmarshalFromBytes of %d/%d bytes returned %v", short, len(data), err)
+			}
+			if err := z.Unmarshal(bytes.NewReader(data[:short])); err == nil {
+				t.Fatalf("Unmarshal of %d/%d bytes succeeded", short, len(data))
+			}
+		}
+	}
+}
+
+// Without -strict, a repeated map key is not an error: the last one wins.
+func TestDuplicateKey(t *testing.T) {
+	x := &Mapped{Counts: map[string]int32{"a": 1}}
+	enc, _ := x.AppendBinary(nil)
+	// ID, then a count of 1 followed by the single "a" entry.
+	entry := enc[3 : 3+6]
+	dup := append([]byte(nil), enc[:2]...)
+	dup = append(dup, 4)
+	dup = append(dup, entry...)
+	dup = append(dup, entry...)
+	dup = append(dup, enc[3+6:]...)
+	y := &Mapped{}
+	if err := y.Unmarshal(bytes.NewReader(dup)); err != nil || !reflect.DeepEqual(y.Counts, x.Counts) {
+		t.Fatalf("Unmarshal returned %v, %v", y.Counts, err)
+	}
+	z := &Mapped{}
+	if n, err := z.UnmarshalFromBytes(dup); err != nil || n != len(dup) || !reflect.DeepEqual(z.Counts, x.Counts) {
+		t.Fatalf("UnmarshalFromBytes returned %v, %d, %v", z.Counts, n, err)
+	}
+}
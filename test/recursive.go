@@ -0,0 +1,15 @@
+package encodedemo
+
+// Types that refer to themselves dispatch to their own methods where
+// they recur.
+type Node struct {
+	V    int32
+	Next *Node
+}
+
+type Tree struct {
+	V    int16
+	Kids []Tree
+}
+
+type Forest []Forest
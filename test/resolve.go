@@ -0,0 +1,34 @@
+package encodedemo
+
+import "time"
+
+// Count is an alias, so it is encoded as a uint32.
+type Count = uint32
+
+type Priority int16
+
+// Level is defined in terms of another named type.
+type Level Priority
+
+type Octet = byte
+
+type Coord struct {
+	X, Y int32
+}
+
+// Spot is the same type as Coord; Corner is a new type built on it.
+type Spot = Coord
+type Corner Coord
+
+type Resolved struct {
+	N     Count
+	L     Level
+	Ls    []Level
+	At    Spot
+	C     Corner
+	Wait  time.Duration
+	Month time.Month
+	Tags  map[Count]Level
+	Raw   []Octet
+	Next  *Corner
+}
@@ -4,3 +4,54 @@ type Sliced struct {
 	A int
 	B []int8
 }
+
+type Label string
+
+type Labeled struct {
+	ID   int32
+	Name string
+	L    Label
+	Tags []string
+	Q    int16
+}
+
+type Point struct {
+	X int32
+	Y int32
+}
+
+type Mapped struct {
+	ID     int16
+	Counts map[string]int32
+	Points map[uint16]Point
+	Seen   map[bool][]byte
+}
+
+type Optional struct {
+	A *int32
+	P *Point
+	L *Labeled
+	N *Point
+	Q int8
+}
+
+type Nest struct {
+	Points []Point
+	Labels []Labeled
+	Blobs  [][]byte
+	Grid   [][]int16
+	Pairs  [2][]uint32
+	Keys   [][4]byte
+	Q      int32
+}
+
+type Blob struct {
+	Key  string
+	Data []byte
+	Seq  uint32
+}
+
+type Sparse struct {
+	P *Point
+	F [2]*int16
+}
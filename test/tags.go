@@ -0,0 +1,22 @@
+package encodedemo
+
+// Packet mixes a big-endian header with a little-endian payload.
+type Packet struct {
+	Magic   uint32   `bin:"be"`
+	Kind    uint16   `bin:"be"`
+	Body    []byte   `bin:"len=u16,max=1500"`
+	Seq     uint64   `bin:"uvarint"`
+	Delta   []int32  `bin:"varint"`
+	Scratch []int    `bin:"-"`
+	Tags    []string `bin:"len=u8,max=4"`
+	Flags   uint16
+}
+
+type Frame struct {
+	ID   uint16 `bin:"be"`
+	Data []byte `bin:"len=u8,max=16"`
+}
+
+type Small struct {
+	V int16 `bin:"varint"`
+}
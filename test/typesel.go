@@ -0,0 +1,15 @@
+package encodedemo
+
+type Envelope struct {
+	In  Inner
+	Seq uint32
+}
+
+type Inner struct {
+	A, B int16
+}
+
+// Only Envelope is generated, so this isn't looked at.
+type conn struct {
+	c chan int
+}